@@ -0,0 +1,649 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const apiTokenPrefix = "apl_"
+
+type ApiErrorBody struct {
+	Error ApiError `json:"error"`
+}
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIのエラーはすべてこの形のJSONで返す
+func apiError(c echo.Context, status int, code string, message string) error {
+	return c.JSON(status, ApiErrorBody{Error: ApiError{Code: code, Message: message}})
+}
+
+// ハンドラーから返すと、echoのエラーハンドラーがapiErrorと同じ形のJSONで返す
+func newApiError(status int, code string, message string) *echo.HTTPError {
+	return echo.NewHTTPError(status, ApiErrorBody{Error: ApiError{Code: code, Message: message}})
+}
+
+// 存在しないパスや受け付けないメソッドも、echoの既定の{"message": ...}ではなくAPIのエラーの形で返す
+func apiRouteErrors() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+				return err
+			}
+			switch {
+			case errors.Is(err, echo.ErrNotFound):
+				return newApiError(http.StatusNotFound, "not_found", "not found")
+			case errors.Is(err, echo.ErrMethodNotAllowed):
+				return newApiError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			}
+			return err
+		}
+	}
+}
+
+func ApiHandlerError(method string, path string, c echo.Context) func(error) error {
+	return func(err error) error {
+		fmt.Printf("error %s %s: %v\n", method, path, err)
+		return apiError(c, http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	authorization := c.Request().Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(authorization, "Bearer "), true
+}
+
+// 個人用APIトークンかセッションクッキーで認証する
+// トークンで認証したときもアカウントの識別にはSessionを使う
+// 認証できなければ401のエラーを返すので、ハンドラーはそのまま返す
+func (s *Server) RequireApiAuth(c echo.Context) (Session, error) {
+	if token, ok := bearerToken(c); ok {
+		apiToken, err := dSelectApiTokenByHash(c.Request().Context(), s.db, hashApiToken(token))
+		if err != nil {
+			return Session{}, newApiError(http.StatusUnauthorized, "unauthorized", "invalid api token")
+		}
+		if err := dUpdateApiTokenLastUsedAt(c.Request().Context(), s.db, apiToken.Id, s.clock.Now()); err != nil {
+			fmt.Printf("failed to update api token: %v\n", err)
+		}
+		return Session{AccountId: apiToken.AccountId, Host: apiToken.Host}, nil
+	}
+	if session, ok := s.LookupSession(c); ok {
+		return session, nil
+	}
+	return Session{}, newApiError(http.StatusUnauthorized, "unauthorized", "login or api token required")
+}
+
+func (s *Server) IssueApiToken(ctx context.Context, accountId string, host string, name string) (ApiToken, string, error) {
+	id, err := randomString(8)
+	if err != nil {
+		return ApiToken{}, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return ApiToken{}, "", err
+	}
+	token := apiTokenPrefix + secret
+	apiToken := ApiToken{Id: id, AccountId: accountId, Host: host, Name: name, TokenHash: hashApiToken(token), CreatedAt: s.clock.Now()}
+	if err := dInsertApiToken(ctx, s.db, apiToken); err != nil {
+		return ApiToken{}, "", err
+	}
+	return apiToken, token, nil
+}
+
+type ApiMediaAttachment struct {
+	Id          string `json:"id"`
+	Type        string `json:"type"`
+	Url         string `json:"url,omitempty"`
+	PreviewUrl  string `json:"preview_url,omitempty"`
+	RemoteUrl   string `json:"remote_url"`
+	Description string `json:"description"`
+}
+
+type ApiStatus struct {
+	Id               string               `json:"id"`
+	Host             string               `json:"host"`
+	Url              string               `json:"url"`
+	CreatedAt        time.Time            `json:"created_at"`
+	EditedAt         *time.Time           `json:"edited_at"`
+	DeletedAt        *time.Time           `json:"deleted_at"`
+	Visibility       string               `json:"visibility"`
+	Content          string               `json:"content"`
+	Text             string               `json:"text"`
+	SpoilerText      string               `json:"spoiler_text"`
+	Sensitive        bool                 `json:"sensitive"`
+	Language         string               `json:"language"`
+	InReplyToId      string               `json:"in_reply_to_id"`
+	ReblogId         string               `json:"reblog_id"`
+	Reblog           *ApiReblog           `json:"reblog"`
+	RepliesCount     int                  `json:"replies_count"`
+	ReblogsCount     int                  `json:"reblogs_count"`
+	FavouritesCount  int                  `json:"favourites_count"`
+	MediaAttachments []ApiMediaAttachment `json:"media_attachments"`
+	// collectionを指定して取得したときの、お気に入りやブックマークにした時刻。わからなければ省略する
+	AddedAt *time.Time `json:"added_at,omitempty"`
+}
+
+// ブーストした時点の元の投稿。添付メディアはブーストした投稿の方に付ける
+type ApiReblog struct {
+	Url         string           `json:"url"`
+	Account     ApiReblogAccount `json:"account"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Content     string           `json:"content"`
+	Text        string           `json:"text"`
+	SpoilerText string           `json:"spoiler_text"`
+	Sensitive   bool             `json:"sensitive"`
+}
+
+type ApiReblogAccount struct {
+	Acct        string `json:"acct"`
+	DisplayName string `json:"display_name"`
+	Url         string `json:"url"`
+	Avatar      string `json:"avatar"`
+}
+
+type ApiStatusRevision struct {
+	Content     string     `json:"content"`
+	Text        string     `json:"text"`
+	SpoilerText string     `json:"spoiler_text"`
+	Sensitive   bool       `json:"sensitive"`
+	EditedAt    *time.Time `json:"edited_at"`
+	ReplacedAt  time.Time  `json:"replaced_at"`
+}
+
+func NewApiStatusRevision(r StatusRevision) ApiStatusRevision {
+	revision := ApiStatusRevision{Content: r.Content, Text: r.Text, SpoilerText: r.SpoilerText, Sensitive: r.Sensitive, ReplacedAt: r.ReplacedAt}
+	if !r.EditedAt.IsZero() {
+		editedAt := r.EditedAt
+		revision.EditedAt = &editedAt
+	}
+	return revision
+}
+
+func NewApiStatus(s Status) ApiStatus {
+	status := ApiStatus{
+		Id:               s.Id,
+		Host:             s.Host,
+		Url:              s.Url,
+		CreatedAt:        s.CreatedAt,
+		Visibility:       s.Visibility,
+		Content:          s.Content,
+		Text:             s.Text,
+		SpoilerText:      s.SpoilerText,
+		Sensitive:        s.Sensitive,
+		Language:         s.Language,
+		InReplyToId:      s.InReplyToId,
+		ReblogId:         s.ReblogId,
+		RepliesCount:     s.RepliesCount,
+		ReblogsCount:     s.ReblogsCount,
+		FavouritesCount:  s.FavouritesCount,
+		MediaAttachments: []ApiMediaAttachment{},
+	}
+	if !s.EditedAt.IsZero() {
+		editedAt := s.EditedAt
+		status.EditedAt = &editedAt
+	}
+	if !s.DeletedAt.IsZero() {
+		deletedAt := s.DeletedAt
+		status.DeletedAt = &deletedAt
+	}
+	if !s.AddedAt.IsZero() {
+		addedAt := s.AddedAt
+		status.AddedAt = &addedAt
+	}
+	if r := s.Reblog; r != nil {
+		status.Reblog = &ApiReblog{
+			Url:         r.Url,
+			Account:     ApiReblogAccount{Acct: r.AccountAcct, DisplayName: r.AccountDisplayName, Url: r.AccountUrl, Avatar: r.AccountAvatar},
+			CreatedAt:   r.CreatedAt,
+			Content:     r.Content,
+			Text:        r.Text,
+			SpoilerText: r.SpoilerText,
+			Sensitive:   r.Sensitive,
+		}
+	}
+	for _, m := range s.MediaAttachments {
+		attachment := ApiMediaAttachment{Id: m.Id, Type: m.Type, RemoteUrl: m.RemoteUrl, Description: m.Description}
+		if m.BlobHash != "" {
+			attachment.Url = "/media/" + m.BlobHash
+		}
+		if m.PreviewBlobHash != "" {
+			attachment.PreviewUrl = "/media/" + m.PreviewBlobHash
+		}
+		status.MediaAttachments = append(status.MediaAttachments, attachment)
+	}
+	return status
+}
+
+// カーソルはHTMLのページと同じmax_id/min_id
+type ApiStatusPage struct {
+	Statuses  []ApiStatus `json:"statuses"`
+	NextMaxId string      `json:"next_max_id,omitempty"`
+	PrevMinId string      `json:"prev_min_id,omitempty"`
+}
+
+// Mastodon APIと同じくLinkヘッダーでも前後のページを示す
+func (s *Server) apiPage(c echo.Context, page Page) error {
+	statuses, err := s.attachMedia(c.Request().Context(), page.Statuses)
+	if err != nil {
+		return ApiHandlerError(c.Request().Method, c.Path(), c)(err)
+	}
+	body := ApiStatusPage{Statuses: []ApiStatus{}, NextMaxId: page.NextMaxId, PrevMinId: page.PrevMinId}
+	for _, status := range statuses {
+		body.Statuses = append(body.Statuses, NewApiStatus(status))
+	}
+	prevUrl, nextUrl := pageLinks(c.Request().URL, page)
+	var links []string
+	if nextUrl != "" {
+		links = append(links, `<`+nextUrl+`>; rel="next"`)
+	}
+	if prevUrl != "" {
+		links = append(links, `<`+prevUrl+`>; rel="prev"`)
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ", "))
+	}
+	return c.JSON(http.StatusOK, body)
+}
+
+type ApiAccount struct {
+	Id           string `json:"id"`
+	Host         string `json:"host"`
+	UserName     string `json:"username"`
+	AllFetched   bool   `json:"all_fetched"`
+	Public       bool   `json:"public"`
+	ShowUnlisted bool   `json:"show_unlisted"`
+	ShowPrivate  bool   `json:"show_private"`
+	ShowDirect   bool   `json:"show_direct"`
+	HideDeleted  bool   `json:"hide_deleted"`
+	ShowReblogs  bool   `json:"show_reblogs"`
+}
+
+func NewApiAccount(a Account) ApiAccount {
+	return ApiAccount{Id: a.Id, Host: a.Host, UserName: a.UserName, AllFetched: a.AllFetched, Public: a.Public, ShowUnlisted: a.ShowUnlisted, ShowPrivate: a.ShowPrivate, ShowDirect: a.ShowDirect, HideDeleted: a.HideDeleted, ShowReblogs: a.ShowReblogs}
+}
+
+// 指定されなかった項目は変更しない
+type ApiAccountUpdate struct {
+	Public       *bool `json:"public"`
+	ShowUnlisted *bool `json:"show_unlisted"`
+	ShowPrivate  *bool `json:"show_private"`
+	ShowDirect   *bool `json:"show_direct"`
+	HideDeleted  *bool `json:"hide_deleted"`
+	ShowReblogs  *bool `json:"show_reblogs"`
+}
+
+type ApiSyncState struct {
+	LastRunAt  *time.Time `json:"last_run_at"`
+	NextRunAt  *time.Time `json:"next_run_at"`
+	LastError  string     `json:"last_error"`
+	AllFetched bool       `json:"all_fetched"`
+	// 最後に作ったジョブ
+	SyncJob *ApiSyncJob `json:"sync_job"`
+}
+
+type ApiSyncJob struct {
+	Id           string     `json:"id"`
+	Kind         string     `json:"kind"`
+	State        string     `json:"state"`
+	Pages        int        `json:"pages"`
+	StatusCount  int        `json:"status_count"`
+	OldestId     string     `json:"oldest_id"`
+	DeletedCount int        `json:"deleted_count"`
+	Error        string     `json:"error"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+}
+
+func NewApiSyncJob(job SyncJob) *ApiSyncJob {
+	if job.Id == "" {
+		return nil
+	}
+	j := &ApiSyncJob{Id: job.Id, Kind: job.Kind, State: job.State, Pages: job.Pages, StatusCount: job.StatusCount, OldestId: job.OldestId, DeletedCount: job.DeletedCount, Error: job.Error, CreatedAt: job.CreatedAt, UpdatedAt: job.UpdatedAt}
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt
+		j.FinishedAt = &finishedAt
+	}
+	return j
+}
+
+func NewApiSyncState(state SyncState, allFetched bool, job SyncJob) ApiSyncState {
+	s := ApiSyncState{LastError: state.LastError, AllFetched: allFetched, SyncJob: NewApiSyncJob(job)}
+	if !state.LastRunAt.IsZero() {
+		lastRunAt := state.LastRunAt
+		s.LastRunAt = &lastRunAt
+	}
+	if !state.NextRunAt.IsZero() {
+		nextRunAt := state.NextRunAt
+		s.NextRunAt = &nextRunAt
+	}
+	return s
+}
+
+type ApiTokenResponse struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// 発行したときだけ返す
+	Token string `json:"token,omitempty"`
+}
+
+func (s *Server) apiSyncState(ctx context.Context, session Session) (ApiSyncState, error) {
+	state, err := dSelectSyncState(ctx, s.db, session.AccountId, session.Host)
+	if err != nil {
+		return ApiSyncState{}, err
+	}
+	allFetched, err := s.store.SelectAccountAllFetched(ctx, session.AccountId, session.Host)
+	if err != nil {
+		return ApiSyncState{}, err
+	}
+	job, err := dSelectLatestSyncJob(ctx, s.db, session.AccountId, session.Host)
+	if err != nil {
+		return ApiSyncState{}, err
+	}
+	return NewApiSyncState(state, allFetched, job), nil
+}
+
+func (s *Server) registerApiRoutes(e *echo.Echo) {
+	api := e.Group("/api/v1")
+	api.File("/openapi.yaml", filepath.Join(s.config.PublicDir, "openapi.yaml"))
+
+	api.GET("/statuses", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/statuses", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		searchQuery := collectionSearchQuery(ParseSearchQuery(c.QueryParam("q"), s.config.Location), c.QueryParam("collection"))
+		page, err := s.selectStatusPage(ctx, session.AccountId, session.Host, searchQuery, ParsePageParams(c.QueryParams()))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return s.apiPage(c, page)
+	})
+	api.GET("/statuses/:id", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/statuses/:id", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		status, err := s.store.SelectStatus(ctx, c.Param("id"), session.AccountId, session.Host)
+		if err == ErrNotFound {
+			return apiError(c, http.StatusNotFound, "not_found", "status not found")
+		}
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err := s.attachMedia(ctx, []Status{status})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, NewApiStatus(statuses[0]))
+	})
+	// 編集される前の版。古い順
+	api.GET("/statuses/:id/revisions", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/statuses/:id/revisions", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		status, err := s.store.SelectStatus(ctx, c.Param("id"), session.AccountId, session.Host)
+		if err == ErrNotFound {
+			return apiError(c, http.StatusNotFound, "not_found", "status not found")
+		}
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		revisions, err := dSelectStatusRevisions(ctx, s.db, status.Id, status.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		res := []ApiStatusRevision{}
+		for _, revision := range revisions {
+			res = append(res, NewApiStatusRevision(revision))
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+	api.GET("/sync", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/sync", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		state, err := s.apiSyncState(ctx, session)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, state)
+	})
+	// headは次の定期同期を今すぐ行い、backfillは古い投稿を遡るジョブを、reconcileは削除された投稿を見つけるジョブを作る
+	api.POST("/sync/:kind", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("POST", "/api/v1/sync/:kind", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		kind := c.Param("kind")
+		switch kind {
+		case "head":
+			if err := s.syncer.Trigger(ctx, session.AccountId, session.Host); err != nil {
+				return SendAndOutputError(err)
+			}
+		case SyncJobBackfill:
+			allFetched, err := s.store.SelectAccountAllFetched(ctx, session.AccountId, session.Host)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			if allFetched {
+				return apiError(c, http.StatusConflict, "all_fetched", "all statuses have already been fetched")
+			}
+			if _, err := s.backfiller.Enqueue(ctx, session.AccountId, session.Host, kind); err != nil {
+				return SendAndOutputError(err)
+			}
+		case SyncJobReconcile:
+			if _, err := s.backfiller.Enqueue(ctx, session.AccountId, session.Host, kind); err != nil {
+				return SendAndOutputError(err)
+			}
+		case SyncJobFavourites, SyncJobBookmarks:
+			state, err := dSelectCollectionState(ctx, s.db, session.AccountId, session.Host, kind)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			if state.AllFetched {
+				return apiError(c, http.StatusConflict, "all_fetched", "all "+kind+" have already been fetched")
+			}
+			if _, err := s.backfiller.Enqueue(ctx, session.AccountId, session.Host, kind); err != nil {
+				return SendAndOutputError(err)
+			}
+		default:
+			return apiError(c, http.StatusNotFound, "not_found", "sync kind must be head, backfill, reconcile, favourites or bookmarks")
+		}
+		state, err := s.apiSyncState(ctx, session)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusAccepted, state)
+	})
+	api.POST("/sync/jobs/:id/:action", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("POST", "/api/v1/sync/jobs/:id/:action", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		switch c.Param("action") {
+		case "cancel":
+			err = s.backfiller.Cancel(ctx, c.Param("id"), session.AccountId, session.Host)
+		case "resume":
+			_, err = s.backfiller.Resume(ctx, c.Param("id"), session.AccountId, session.Host)
+		default:
+			return apiError(c, http.StatusNotFound, "not_found", "action must be cancel or resume")
+		}
+		if err == ErrNotFound {
+			return apiError(c, http.StatusNotFound, "not_found", "sync job not found")
+		}
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		state, err := s.apiSyncState(ctx, session)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, state)
+	})
+	api.GET("/account", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/account", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		account, err := s.store.SelectAccount(ctx, session.AccountId, session.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusOK, NewApiAccount(account))
+	})
+	api.PATCH("/account", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("PATCH", "/api/v1/account", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		var update ApiAccountUpdate
+		if err := c.Bind(&update); err != nil {
+			return apiError(c, http.StatusBadRequest, "bad_request", "invalid request body")
+		}
+		account, err := s.store.SelectAccount(ctx, session.AccountId, session.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if update.Public != nil {
+			account.Public = *update.Public
+			if err := s.store.UpdateAccountPublic(ctx, account.Id, account.Host, account.Public); err != nil {
+				return SendAndOutputError(err)
+			}
+		}
+		if update.ShowUnlisted != nil || update.ShowPrivate != nil || update.ShowDirect != nil {
+			if update.ShowUnlisted != nil {
+				account.ShowUnlisted = *update.ShowUnlisted
+			}
+			if update.ShowPrivate != nil {
+				account.ShowPrivate = *update.ShowPrivate
+			}
+			if update.ShowDirect != nil {
+				account.ShowDirect = *update.ShowDirect
+			}
+			if err := s.store.UpdateAccountVisibility(ctx, account.Id, account.Host, account.ShowUnlisted, account.ShowPrivate, account.ShowDirect); err != nil {
+				return SendAndOutputError(err)
+			}
+		}
+		if update.HideDeleted != nil {
+			account.HideDeleted = *update.HideDeleted
+			if err := s.store.UpdateAccountHideDeleted(ctx, account.Id, account.Host, account.HideDeleted); err != nil {
+				return SendAndOutputError(err)
+			}
+		}
+		if update.ShowReblogs != nil {
+			account.ShowReblogs = *update.ShowReblogs
+			if err := s.store.UpdateAccountShowReblogs(ctx, account.Id, account.Host, account.ShowReblogs); err != nil {
+				return SendAndOutputError(err)
+			}
+		}
+		return c.JSON(http.StatusOK, NewApiAccount(account))
+	})
+	api.GET("/users/:host/:username/statuses", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/users/:host/:username/statuses", c)
+		ctx := c.Request().Context()
+		username := c.Param("username")
+		host := c.Param("host")
+		account, err := s.store.SelectAccountByUserName(ctx, username, host)
+		if err != nil || !account.Public {
+			return apiError(c, http.StatusNotFound, "not_found", "user not found")
+		}
+		page, err := s.store.SelectStatusesByAccountWithRestriction(ctx, username, host, c.QueryParam("tag"), ParsePageParams(c.QueryParams()))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return s.apiPage(c, page)
+	})
+	api.GET("/tokens", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("GET", "/api/v1/tokens", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		tokens, err := dSelectApiTokens(ctx, s.db, session.AccountId, session.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		res := []ApiTokenResponse{}
+		for _, token := range tokens {
+			res = append(res, ApiTokenResponse{Id: token.Id, Name: token.Name, CreatedAt: token.CreatedAt})
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+	api.POST("/tokens", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("POST", "/api/v1/tokens", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return apiError(c, http.StatusBadRequest, "bad_request", "invalid request body")
+		}
+		apiToken, token, err := s.IssueApiToken(ctx, session.AccountId, session.Host, req.Name)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.JSON(http.StatusCreated, ApiTokenResponse{Id: apiToken.Id, Name: apiToken.Name, CreatedAt: apiToken.CreatedAt, Token: token})
+	})
+	api.DELETE("/tokens/:id", func(c echo.Context) error {
+		SendAndOutputError := ApiHandlerError("DELETE", "/api/v1/tokens/:id", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireApiAuth(c)
+		if err != nil {
+			return err
+		}
+		deleted, err := dDeleteApiToken(ctx, s.db, c.Param("id"), session.AccountId, session.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !deleted {
+			return apiError(c, http.StatusNotFound, "not_found", "token not found")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,158 @@
+package activitypublog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestApiRequiresAuth(t *testing.T) {
+	e := echo.New()
+	newTestServer(t, nil).registerApiRoutes(e)
+	for _, tt := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/api/v1/statuses"},
+		{http.MethodGet, "/api/v1/account"},
+		{http.MethodPatch, "/api/v1/account"},
+		{http.MethodPost, "/api/v1/sync/head"},
+		{http.MethodDelete, "/api/v1/tokens/1"},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, http.StatusUnauthorized)
+			continue
+		}
+		var body ApiErrorBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: %v: %s", tt.method, tt.path, err, rec.Body)
+			continue
+		}
+		if want := (ApiError{Code: "unauthorized", Message: "login or api token required"}); body.Error != want {
+			t.Errorf("%s %s error = %+v, want %+v", tt.method, tt.path, body.Error, want)
+		}
+	}
+}
+
+// APIトークンで認証してリクエストし、ステータスとボディを返す
+func serveApi(t *testing.T, s *Server, method string, path string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeApiError(t *testing.T, rec *httptest.ResponseRecorder) ApiError {
+	t.Helper()
+	var body ApiErrorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return body.Error
+}
+
+func TestApiToken(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(t, fixedClock{now})
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	apiToken, token, err := s.IssueApiToken(ctx, "1", testHost, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveApi(t, s, http.MethodGet, "/api/v1/account", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid token = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var account ApiAccount
+	if err := json.Unmarshal(rec.Body.Bytes(), &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Id != "1" || account.Host != testHost {
+		t.Errorf("account = %+v, want alice", account)
+	}
+	used, err := dSelectApiTokenByHash(ctx, s.db, apiToken.TokenHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !used.LastUsedAt.Equal(now) {
+		t.Errorf("last_used_at = %v, want %v", used.LastUsedAt, now)
+	}
+
+	rec = serveApi(t, s, http.MethodGet, "/api/v1/account", token+"x")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("invalid token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got, want := decodeApiError(t, rec), (ApiError{Code: "unauthorized", Message: "invalid api token"}); got != want {
+		t.Errorf("invalid token error = %+v, want %+v", got, want)
+	}
+}
+
+func TestApiRouteErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := s.IssueApiToken(ctx, "1", testHost, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		path   string
+		status int
+		want   ApiError
+	}{
+		{http.MethodGet, "/api/v1/unknown", http.StatusNotFound, ApiError{Code: "not_found", Message: "not found"}},
+		{http.MethodGet, "/api/v2/statuses", http.StatusNotFound, ApiError{Code: "not_found", Message: "not found"}},
+		{http.MethodPut, "/api/v1/statuses", http.StatusMethodNotAllowed, ApiError{Code: "method_not_allowed", Message: "method not allowed"}},
+		{http.MethodDelete, "/api/v1/account", http.StatusMethodNotAllowed, ApiError{Code: "method_not_allowed", Message: "method not allowed"}},
+	}
+	for _, tt := range tests {
+		rec := serveApi(t, s, tt.method, tt.path, token)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		if got := decodeApiError(t, rec); got != tt.want {
+			t.Errorf("%s %s error = %+v, want %+v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer apl_abc", "apl_abc", true},
+		{"", "", false},
+		{"Basic YWJj", "", false},
+		{"bearer apl_abc", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", tt.header)
+		token, ok := bearerToken(echo.New().NewContext(req, httptest.NewRecorder()))
+		if token != tt.token || ok != tt.ok {
+			t.Errorf("bearerToken(%q) = %q, %v, want %q, %v", tt.header, token, ok, tt.token, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package activitypublog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ユーザーが止めたので、ワーカーはジョブを終わらせずに手を離す
+var errSyncJobCancelled = errors.New("sync job cancelled")
+
+// 古い投稿やお気に入り・ブックマークを遡るジョブと、削除された投稿を見つけるジョブを1つずつ処理するワーカー
+// 新しい投稿の同期(Syncer)とは別のgoroutineで動くので、長い遡りの途中でも定期同期は止まらない
+type Backfiller struct {
+	server *Server
+	kick   chan struct{}
+
+	mu sync.Mutex
+	// 処理中のジョブを止めるときに呼ぶ
+	runningId     string
+	cancelRunning context.CancelFunc
+}
+
+func NewBackfiller(server *Server) *Backfiller {
+	return &Backfiller{server: server, kick: make(chan struct{}, 1)}
+}
+
+// 動いているジョブがあれば、種類が違っても新しいジョブは作らずにそれを返す
+func (b *Backfiller) Enqueue(ctx context.Context, accountId string, host string, kind string) (SyncJob, error) {
+	latest, err := dSelectLatestSyncJob(ctx, b.server.db, accountId, host)
+	if err != nil {
+		return latest, err
+	}
+	if latest.Active() {
+		return latest, nil
+	}
+	id, err := randomString(16)
+	if err != nil {
+		return SyncJob{}, err
+	}
+	now := b.server.clock.Now()
+	job := SyncJob{Id: id, AccountId: accountId, Host: host, Kind: kind, State: SyncJobQueued, CreatedAt: now, UpdatedAt: now}
+	if err := dInsertSyncJob(ctx, b.server.db, job); err != nil {
+		return SyncJob{}, err
+	}
+	b.wake()
+	return job, nil
+}
+
+// 止めたか失敗したジョブを、数え上げた進み具合はそのままにもう一度待ち行列に入れる
+// 遡りはどこまで取り込んだかがDBの投稿からわかるので続きから取得する。reconcileは最後に調べ終えたページの続きからたどる
+func (b *Backfiller) Resume(ctx context.Context, id string, accountId string, host string) (SyncJob, error) {
+	job, err := dSelectSyncJob(ctx, b.server.db, id, accountId, host)
+	if err != nil {
+		return job, err
+	}
+	latest, err := dSelectLatestSyncJob(ctx, b.server.db, accountId, host)
+	if err != nil {
+		return job, err
+	}
+	if latest.Active() {
+		return latest, nil
+	}
+	ok, err := dUpdateSyncJobStateIf(ctx, b.server.db, id, []string{SyncJobCancelled, SyncJobFailed}, SyncJobQueued, "", b.server.clock.Now())
+	if err != nil {
+		return job, err
+	}
+	if ok {
+		job.State = SyncJobQueued
+		job.Error = ""
+		b.wake()
+	}
+	return job, nil
+}
+
+func (b *Backfiller) Cancel(ctx context.Context, id string, accountId string, host string) error {
+	if _, err := dSelectSyncJob(ctx, b.server.db, id, accountId, host); err != nil {
+		return err
+	}
+	ok, err := dUpdateSyncJobStateIf(ctx, b.server.db, id, []string{SyncJobQueued, SyncJobRunning}, SyncJobCancelled, "", b.server.clock.Now())
+	if err != nil || !ok {
+		return err
+	}
+	// 別のプロセスで動いていれば、そちらは次のページを取り込む前に気づいて止まる
+	b.mu.Lock()
+	if b.runningId == id {
+		b.cancelRunning()
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backfiller) wake() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// 起動したときに残っているrunningのジョブは前回のプロセスが途中で止まったものなので、続きから動かす
+// ctxがキャンセルされるまで戻らない
+func (b *Backfiller) Run(ctx context.Context) {
+	for {
+		b.runUnfinished(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.kick:
+		}
+	}
+}
+
+func (b *Backfiller) runUnfinished(ctx context.Context) {
+	jobs, err := dSelectUnfinishedSyncJobs(ctx, b.server.db)
+	if err != nil {
+		fmt.Printf("backfill: failed to select jobs: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		b.run(ctx, job)
+	}
+}
+
+func (b *Backfiller) run(ctx context.Context, job SyncJob) {
+	s := b.server
+	ok, err := dUpdateSyncJobStateIf(ctx, s.db, job.Id, []string{SyncJobQueued, SyncJobRunning}, SyncJobRunning, "", s.clock.Now())
+	if err != nil || !ok {
+		if err != nil {
+			fmt.Printf("backfill %s: %v\n", job.Id, err)
+		}
+		return
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.mu.Lock()
+	b.runningId, b.cancelRunning = job.Id, cancel
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.runningId, b.cancelRunning = "", nil
+		b.mu.Unlock()
+	}()
+
+	err = b.process(jobCtx, &job)
+	if ctx.Err() != nil {
+		// runningのまま残しておけば次に起動したときに続きから動く
+		return
+	}
+	state, errString := SyncJobDone, ""
+	if err != nil {
+		state, errString = SyncJobFailed, truncateError(err.Error())
+		fmt.Printf("backfill %s: %v\n", job.Id, err)
+	}
+	// 止められていたら何もしない
+	if _, err := dUpdateSyncJobStateIf(ctx, s.db, job.Id, []string{SyncJobRunning}, state, errString, s.clock.Now()); err != nil {
+		fmt.Printf("backfill %s: %v\n", job.Id, err)
+	}
+}
+
+func (b *Backfiller) process(ctx context.Context, job *SyncJob) error {
+	s := b.server
+	token, err := dSelectCredentialToken(ctx, s.db, s.config.CredentialKey, job.AccountId, job.Host)
+	if err != nil {
+		return err
+	}
+	client := s.mastodonClient(job.Host, token)
+	var result UpsertResult
+	onPage := func(statuses []Status, r UpsertResult) error {
+		result.Add(r)
+		job.Pages++
+		job.StatusCount += len(statuses)
+		job.OldestId = statuses[len(statuses)-1].Id
+		job.UpdatedAt = s.clock.Now()
+		if err := dUpdateSyncJobProgress(ctx, s.db, *job); err != nil {
+			return err
+		}
+		state, err := dSelectSyncJobState(ctx, s.db, job.Id)
+		if err != nil {
+			return err
+		}
+		if state == SyncJobCancelled {
+			return errSyncJobCancelled
+		}
+		return nil
+	}
+	switch {
+	case job.Kind == SyncJobReconcile:
+		var deleted int64
+		// 削除済みにした数はページと一緒に保存するので、止まっても数え直さなくてよい
+		deleted, err = s.syncReconcile(ctx, client, job.AccountId, job.OldestId, func(statuses []Status, r UpsertResult, deleted int64) error {
+			job.DeletedCount += int(deleted)
+			return onPage(statuses, r)
+		})
+		if deleted > 0 {
+			job.DeletedCount += int(deleted)
+			job.UpdatedAt = s.clock.Now()
+			if err := dUpdateSyncJobProgress(ctx, s.db, *job); err != nil {
+				return err
+			}
+		}
+	case IsCollection(job.Kind):
+		err = s.syncCollectionBackfill(ctx, client, job.AccountId, job.Kind, onPage)
+	default:
+		err = s.syncBackfill(ctx, client, job.AccountId, onPage)
+	}
+	fmt.Printf("%s %s: %s\n", job.Kind, job.Id, result)
+	if err != nil {
+		return err
+	}
+	return s.archivePendingMedia(ctx, job.AccountId, job.Host)
+}
+
+// errorのカラムに入る長さにする
+func truncateError(s string) string {
+	r := []rune(s)
+	if len(r) > 1000 {
+		return string(r[:1000])
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package activitypublog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackfillerJobStates(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, fixedClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)})
+	b := s.backfiller
+	for _, id := range []string{"1", "2"} {
+		if _, err := s.store.InsertAccountIfNotExists(ctx, id, "user"+id, testHost); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job, err := b.Enqueue(ctx, "1", testHost, SyncJobBackfill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != SyncJobQueued {
+		t.Errorf("state = %s, want %s", job.State, SyncJobQueued)
+	}
+	// 動いているジョブがあれば同じものを返す
+	if again, err := b.Enqueue(ctx, "1", testHost, SyncJobBackfill); err != nil || again.Id != job.Id {
+		t.Errorf("Enqueue = %s, %v, want %s", again.Id, err, job.Id)
+	}
+	if err := b.Cancel(ctx, job.Id, "2", testHost); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel by another account = %v, want ErrNotFound", err)
+	}
+
+	if err := b.Cancel(ctx, job.Id, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := dSelectSyncJob(ctx, s.db, job.Id, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.State != SyncJobCancelled {
+		t.Errorf("state = %s, want %s", cancelled.State, SyncJobCancelled)
+	}
+
+	resumed, err := b.Resume(ctx, job.Id, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Id != job.Id || resumed.State != SyncJobQueued {
+		t.Errorf("Resume = %+v", resumed)
+	}
+	// 待ち行列にあるうちは新しいジョブを作らない
+	if again, err := b.Enqueue(ctx, "1", testHost, SyncJobBackfill); err != nil || again.Id != job.Id {
+		t.Errorf("Enqueue = %s, %v, want %s", again.Id, err, job.Id)
+	}
+}
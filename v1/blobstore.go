@@ -0,0 +1,237 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// メディアの実体を置く場所
+// キーは内容のsha256なので、同じファイルは一度しか保存されない
+type BlobStore interface {
+	Exists(ctx context.Context, key string) (bool, error)
+	// rの中身はsha256がkeyと一致していること
+	Put(ctx context.Context, key string, contentType string, r io.ReadSeeker, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+func newBlobStore(config MediaConfig) (BlobStore, error) {
+	switch config.Storage {
+	case "", "local":
+		dir := config.Dir
+		if dir == "" {
+			dir = "media"
+		}
+		return NewLocalBlobStore(dir)
+	case "s3":
+		store := &S3BlobStore{
+			Endpoint:        config.S3Endpoint,
+			Bucket:          config.S3Bucket,
+			Region:          config.S3Region,
+			AccessKeyId:     config.S3AccessKeyId,
+			SecretAccessKey: config.S3SecretAccessKey,
+			Client:          &http.Client{Timeout: 5 * time.Minute},
+		}
+		if store.Endpoint == "" || store.Bucket == "" || store.AccessKeyId == "" || store.SecretAccessKey == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for MEDIA_STORAGE=s3")
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown MEDIA_STORAGE: %s", config.Storage)
+	}
+}
+
+func blobPath(key string) string {
+	if len(key) < 4 {
+		return key
+	}
+	return key[0:2] + "/" + key[2:4] + "/" + key
+}
+
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("NewLocalBlobStore: %v", err)
+	}
+	return &LocalBlobStore{root: root}, nil
+}
+
+func (s *LocalBlobStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(blobPath(key)))
+}
+
+func (s *LocalBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("LocalBlobStore.Exists: %v", err)
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, contentType string, r io.ReadSeeker, size int64) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %v", err)
+	}
+	// 書き込み途中のファイルが見えないように一時ファイルからrenameする
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("LocalBlobStore.Put: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %v", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %v", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LocalBlobStore.Get: %v", err)
+	}
+	return f, nil
+}
+
+// S3互換のストレージ(MinIO, Cloudflare R2など)にpath-styleでアクセスする
+type S3BlobStore struct {
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+func (s *S3BlobStore) objectUrl(key string) string {
+	return strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + blobPath(key)
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, "", nil, 0, emptyPayloadHash)
+	if err != nil {
+		return false, fmt.Errorf("S3BlobStore.Exists: %v", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("S3BlobStore.Exists: status %d", resp.StatusCode)
+	}
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, contentType string, r io.ReadSeeker, size int64) error {
+	// keyは中身のsha256なので、そのまま署名用のペイロードハッシュになる
+	resp, err := s.do(ctx, http.MethodPut, key, contentType, r, size, key)
+	if err != nil {
+		return fmt.Errorf("S3BlobStore.Put: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3BlobStore.Put: status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, "", nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("S3BlobStore.Get: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3BlobStore.Get: status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// AWS Signature Version 4で署名してリクエストする
+func (s *S3BlobStore) do(ctx context.Context, method string, key string, contentType string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectUrl(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSha256(signingKey, s.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyId+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return s.Client.Do(req)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,9 +1,55 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	// コンテナなどにタイムゾーンのデータがなくてもTIMEZONEを使えるようにする
+	_ "time/tzdata"
+
 	"github.com/chao7150/activitypublog"
 )
 
+// server [flags]
+// server import [flags] -user alice -host mastodon.example archive.zip
+// server migrate [flags] [up|down|status]
 func main() {
-	activitypublog.StartServer()
+	command := ""
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "import" || args[0] == "migrate") {
+		command = args[0]
+		args = args[1:]
+	}
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	loader := activitypublog.NewConfigLoader(fs)
+	switch command {
+	case "import":
+		runImport(fs, loader, args)
+	case "migrate":
+		fs.Parse(args)
+		activitypublog.RunMigrate(loadConfig(loader), fs.Arg(0))
+	default:
+		fs.Parse(args)
+		activitypublog.StartServer(loadConfig(loader))
+	}
+}
+
+func loadConfig(loader *activitypublog.ConfigLoader) activitypublog.Config {
+	config, err := loader.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return config
+}
+
+func runImport(fs *flag.FlagSet, loader *activitypublog.ConfigLoader, args []string) {
+	user := fs.String("user", "", "username of the account to import into")
+	host := fs.String("host", "", "instance host of the account")
+	fs.Parse(args)
+	if *user == "" || *host == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: server import [flags] -user USERNAME -host HOST ARCHIVE")
+		os.Exit(2)
+	}
+	activitypublog.RunImport(loadConfig(loader), fs.Arg(0), *user, *host)
 }
@@ -0,0 +1,177 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/chao7150/activitypublog/mastodon"
+)
+
+// 新しい方の同期で一度にたどるページの上限。これより多くたまっていたら次の同期で続きを取得する
+const collectionHeadMaxPages = 25
+
+// コレクションの新しい方から、もう入っている投稿が出てくるまで取り込む
+// 一度も取り込んだことがなければ何もしない。最初の取り込みは遡りのジョブがする
+// お気に入りとブックマークのページは最後に追加した順なので、途中から取得し直すカーソルは使わずに毎回先頭からたどる
+func (s *Server) syncCollectionHead(ctx context.Context, client *mastodon.Client, accountId string, collection string) (int, error) {
+	state, err := dSelectCollectionState(ctx, s.db, accountId, client.Host, collection)
+	if err != nil || state.Collection == "" {
+		return 0, err
+	}
+	now := s.clock.Now()
+	added := 0
+	pages := 0
+	pager := hCollectionPages(client, collection, url.Values{}, mastodon.RelNext)
+	for pager.Next(ctx) {
+		statuses, _, n, err := s.ingestCollectionPage(ctx, client.Host, accountId, collection, pager.Page(), now)
+		if err != nil {
+			return added, err
+		}
+		added += n
+		pages++
+		if n < len(statuses) || pages >= collectionHeadMaxPages {
+			break
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return added, fmt.Errorf("failed to GET %s: %w", collection, err)
+	}
+	return added, nil
+}
+
+// コレクションの古い方へ、インスタンスが返さなくなるまで取り込む
+// 1ページごとに次のページのカーソルを保存するので、途中で止まっても次は続きから取得する
+// onPageはsyncBackfillと同じく1ページ保存するたびに呼ばれる
+func (s *Server) syncCollectionBackfill(ctx context.Context, client *mastodon.Client, accountId string, collection string, onPage func(statuses []Status, result UpsertResult) error) error {
+	host := client.Host
+	state, err := dSelectCollectionState(ctx, s.db, accountId, host, collection)
+	if err != nil {
+		return err
+	}
+	if state.AllFetched {
+		return nil
+	}
+	state.AccountId, state.Host, state.Collection = accountId, host, collection
+	params := url.Values{}
+	if state.MaxId != "" {
+		params.Set("max_id", state.MaxId)
+	}
+	pager := hCollectionPages(client, collection, params, mastodon.RelNext)
+	for pager.Next(ctx) {
+		statuses, result, _, err := s.ingestCollectionPage(ctx, host, accountId, collection, pager.Page(), time.Time{})
+		if err != nil {
+			return err
+		}
+		if next := pager.NextParams(); next != nil {
+			state.MaxId = next.Get("max_id")
+		} else {
+			state.AllFetched = true
+		}
+		if err := dUpsertCollectionState(ctx, s.db, state); err != nil {
+			return err
+		}
+		if err := onPage(statuses, result); err != nil {
+			return err
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return fmt.Errorf("failed to GET %s: %w", collection, err)
+	}
+	state.AllFetched = true
+	return dUpsertCollectionState(ctx, s.db, state)
+}
+
+// 投稿を投稿者のものとして保存してからコレクションに入れる。3つ目の戻り値は新しくコレクションに入った数
+// 投稿者の投稿一覧やカーソルに混ざらないように、sourceをcollectionにしておく
+// addedAtはお気に入りやブックマークにした時刻として残す。わからなければゼロ
+func (s *Server) ingestCollectionPage(ctx context.Context, host string, accountId string, collection string, page []mastodon.Status, addedAt time.Time) ([]Status, UpsertResult, int, error) {
+	statuses := make([]Status, 0, len(page))
+	var ids []string
+	authors := map[string]string{}
+	for _, v := range page {
+		status := hConvertStatus(v, host, v.Account.Id)
+		status.Source = StatusSourceCollection
+		statuses = append(statuses, status)
+		ids = append(ids, v.Id)
+		authors[v.Account.Id] = v.Account.Acct
+	}
+	// statusは投稿者のaccountを参照するので、投稿者も入れておく
+	// 他のインスタンスのアカウントはacctに@が入るので、ここでログインしたアカウントのユーザー名とは重ならない
+	// ログインしていないアカウントは公開されず、同期もされない
+	for id, acct := range authors {
+		if _, err := s.store.InsertAccountIfNotExists(ctx, id, acct, host); err != nil {
+			return statuses, UpsertResult{}, 0, err
+		}
+	}
+	result, err := s.ingestStatuses(ctx, statuses, accountId, host)
+	if err != nil {
+		return statuses, result, 0, err
+	}
+	existing, err := dSelectCollectionStatusIds(ctx, s.db, accountId, host, collection, ids)
+	if err != nil {
+		return statuses, result, 0, err
+	}
+	var items []CollectionItem
+	for _, status := range statuses {
+		if !existing[status.Id] {
+			items = append(items, CollectionItem{AccountId: accountId, Host: host, Collection: collection, StatusId: status.Id, AddedAt: addedAt})
+		}
+	}
+	if err := dInsertCollectionItems(ctx, s.db, items); err != nil {
+		return statuses, result, 0, err
+	}
+	return statuses, result, len(items), nil
+}
+
+// 新しい方の同期と、まだ遡り終わっていなければ遡りのジョブの登録を、コレクションごとにする
+// コレクションから入れた投稿は投稿者の投稿一覧には出ないので、自分の投稿の遡りとは関係なく遡ってよい
+func (s *Server) syncCollections(ctx context.Context, client *mastodon.Client, accountId string) error {
+	for _, collection := range Collections {
+		added, err := s.syncCollectionHead(ctx, client, accountId, collection)
+		if err != nil {
+			return fmt.Errorf("%s: %w", collection, err)
+		}
+		if added > 0 {
+			fmt.Printf("sync %s@%s %s: %d added\n", accountId, client.Host, collection, added)
+		}
+		state, err := dSelectCollectionState(ctx, s.db, accountId, client.Host, collection)
+		if err != nil {
+			return err
+		}
+		if !state.AllFetched {
+			if err := s.enqueueSyncJobOnce(ctx, accountId, client.Host, collection); err != nil {
+				return fmt.Errorf("%s: %w", collection, err)
+			}
+		}
+	}
+	return nil
+}
+
+// トップページとAPIの投稿一覧。検索語がなければ新しい順に並べる
+// q.Collectionが空でなければそのコレクションから取得し、お気に入りやブックマークにした時刻も載せる
+func (s *Server) selectStatusPage(ctx context.Context, accountId string, host string, q SearchQuery, params PageParams) (Page, error) {
+	var page Page
+	var err error
+	switch {
+	case !q.IsEmpty():
+		page, err = s.searcher.Search(ctx, accountId, host, q, params)
+	case q.Collection != "":
+		page, err = dSelectStatusesByCollection(ctx, s.db, accountId, host, q.Collection, params)
+	default:
+		page, err = s.store.SelectStatusesByAccount(ctx, accountId, host, params)
+	}
+	if err != nil || q.Collection == "" {
+		return page, err
+	}
+	return page, dAttachCollectionAddedAt(ctx, s.db, accountId, host, q.Collection, page.Statuses)
+}
+
+// ?collection=のタブを検索語のin:より後に見る
+func collectionSearchQuery(q SearchQuery, collection string) SearchQuery {
+	if q.Collection == "" && IsCollection(collection) {
+		q.Collection = collection
+	}
+	return q
+}
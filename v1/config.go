@@ -0,0 +1,352 @@
+package activitypublog
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// サーバーの設定
+type Config struct {
+	// 待ち受けるアドレス
+	Addr string
+	// OAuthのリダイレクト先やフィードのURLに使う、外から見たこのサーバーのURL
+	BaseUrl     string
+	DatabaseUrl string
+	// 画面に表示する日時と、検索のbefore:やafter:の日付のタイムゾーン
+	Location *time.Location
+	// DBに保存するトークンを暗号化するための32バイトの鍵
+	CredentialKey []byte
+	// セッションクッキーに署名するための鍵
+	SessionSecret []byte
+	SyncInterval  time.Duration
+	// 同じインスタンスに続けてリクエストするときに空ける間隔
+	RequestInterval time.Duration
+	// ストリーミングAPIで新しい投稿をすぐに取り込む。falseなら定期同期だけ
+	Streaming bool
+	// インスタンスにアプリを登録するときの名前
+	OAuthClientName string
+	// テンプレートとopenapi.yamlを置くディレクトリ
+	PublicDir string
+	AssetsDir string
+	ExportDir string
+	// /importsにアップロードできるアーカイブの大きさ
+	ImportMaxBytes int64
+	Media          MediaConfig
+}
+
+// local ならDirに、s3 ならS3互換のストレージに保存する
+type MediaConfig struct {
+	Storage string
+	Dir     string
+	// これより大きいファイルはダウンロードを途中でやめて保存しない
+	MaxBytes          int64
+	S3Endpoint        string
+	S3Bucket          string
+	S3Region          string
+	S3AccessKeyId     string
+	S3SecretAccessKey string
+}
+
+// 設定できる項目。ファイルと環境変数ではenvの名前で、フラグではflagの名前で指定する
+// 秘密の値はpsなどで見えてしまうのでフラグでは指定できないようにしている
+type configKey struct {
+	env          string
+	flag         string
+	defaultValue string
+	usage        string
+}
+
+var configKeys = []configKey{
+	{"ADDR", "addr", ":1323", "address to listen on"},
+	{"BASE_URL", "base-url", "", "public URL of this server, e.g. https://archive.example"},
+	{"DATABASE_URL", "database-url", "", "mysql://, postgres:// or sqlite: DSN. MYSQL_* are used when empty"},
+	{"MYSQL_USER", "", "", ""},
+	{"MYSQL_PASSWORD", "", "", ""},
+	{"MYSQL_HOST", "", "", ""},
+	{"MYSQL_PORT", "", "3306", ""},
+	{"MYSQL_DATABASE", "", "", ""},
+	{"TIMEZONE", "timezone", "Asia/Tokyo", "time zone used to display dates"},
+	{"CREDENTIAL_KEY", "", "", ""},
+	{"SESSION_SECRET", "", "", ""},
+	{"SYNC_INTERVAL", "sync-interval", "30m", "interval between syncs of each account"},
+	{"REQUEST_INTERVAL", "request-interval", "2s", "wait between consecutive requests to an instance"},
+	{"STREAMING", "streaming", "true", "ingest new statuses in real time via the streaming API"},
+	{"OAUTH_CLIENT_NAME", "oauth-client-name", "chao-activitypublog", "application name registered on instances"},
+	{"PUBLIC_DIR", "public-dir", "public", "directory containing views, export templates and openapi.yaml"},
+	{"ASSETS_DIR", "assets-dir", "assets", "directory served under /static"},
+	{"EXPORT_DIR", "export-dir", "exports", "directory to write export archives to"},
+	{"IMPORT_MAX_BYTES", "import-max-bytes", "1073741824", "largest archive that can be uploaded to /imports, in bytes"},
+	{"MEDIA_STORAGE", "media-storage", "local", "local or s3"},
+	{"MEDIA_DIR", "media-dir", "media", "directory to store media in when media-storage is local"},
+	{"MEDIA_MAX_BYTES", "media-max-bytes", "104857600", "largest media file to download, in bytes"},
+	{"S3_ENDPOINT", "s3-endpoint", "", ""},
+	{"S3_BUCKET", "s3-bucket", "", ""},
+	{"S3_REGION", "s3-region", "us-east-1", ""},
+	{"S3_ACCESS_KEY_ID", "", "", ""},
+	{"S3_SECRET_ACCESS_KEY", "", "", ""},
+}
+
+// 何も指定しなければカレントディレクトリの.envを、あれば読む
+const defaultConfigPath = ".env"
+
+// 設定ファイル、環境変数、フラグの順に読み、後から読んだものを優先する
+// 設定ファイルは.envと同じKEY=VALUEの形式で、キーは環境変数と同じ
+type ConfigLoader struct {
+	flags *flag.FlagSet
+	path  *string
+	// 環境変数の名前からフラグの値へ
+	values map[string]*string
+}
+
+// flagsに設定のフラグを登録する。LoadはflagsをParseしてから呼ぶ
+func NewConfigLoader(flags *flag.FlagSet) *ConfigLoader {
+	l := &ConfigLoader{flags: flags, values: map[string]*string{}}
+	l.path = flags.String("config", defaultConfigPath, "config file in KEY=VALUE format")
+	for _, key := range configKeys {
+		if key.flag == "" {
+			continue
+		}
+		usage := key.usage
+		if usage == "" {
+			usage = key.env
+		} else {
+			usage += " (" + key.env + ")"
+		}
+		l.values[key.env] = flags.String(key.flag, key.defaultValue, usage)
+	}
+	return l
+}
+
+func (l *ConfigLoader) Load() (Config, error) {
+	setFlags := map[string]bool{}
+	l.flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	values := map[string]string{}
+	for _, key := range configKeys {
+		values[key.env] = key.defaultValue
+	}
+
+	file, err := readConfigFile(*l.path, setFlags["config"])
+	if err != nil {
+		return Config{}, err
+	}
+	known := map[string]bool{}
+	for _, key := range configKeys {
+		known[key.env] = true
+	}
+	for k, v := range file {
+		if !known[k] {
+			fmt.Printf("config: ignoring unknown key %s in %s\n", k, *l.path)
+			continue
+		}
+		values[k] = v
+	}
+	for _, key := range configKeys {
+		if v := os.Getenv(key.env); v != "" {
+			values[key.env] = v
+		}
+		if key.flag != "" && setFlags[key.flag] {
+			values[key.env] = *l.values[key.env]
+		}
+	}
+	return parseConfig(values)
+}
+
+// 明示的に指定されたファイルがなければエラーにする
+func readConfigFile(path string, explicit bool) (map[string]string, error) {
+	values, err := godotenv.Read(path)
+	if os.IsNotExist(err) && !explicit {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// 設定のどこが悪いかをまとめて返す
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func parseConfig(values map[string]string) (Config, error) {
+	problems := &ConfigError{}
+	duration := func(key string) time.Duration {
+		d, err := time.ParseDuration(values[key])
+		if err != nil {
+			problems.add("%s: %q is not a duration like 30m or 2s", key, values[key])
+		}
+		return d
+	}
+	integer := func(key string) int64 {
+		n, err := strconv.ParseInt(values[key], 10, 64)
+		if err != nil {
+			problems.add("%s: %q is not an integer", key, values[key])
+		}
+		return n
+	}
+	boolean := func(key string) bool {
+		b, err := strconv.ParseBool(values[key])
+		if err != nil {
+			problems.add("%s: %q is not true or false", key, values[key])
+		}
+		return b
+	}
+	config := Config{
+		Addr:            values["ADDR"],
+		BaseUrl:         strings.TrimSuffix(values["BASE_URL"], "/"),
+		DatabaseUrl:     values["DATABASE_URL"],
+		SyncInterval:    duration("SYNC_INTERVAL"),
+		RequestInterval: duration("REQUEST_INTERVAL"),
+		Streaming:       boolean("STREAMING"),
+		OAuthClientName: values["OAUTH_CLIENT_NAME"],
+		PublicDir:       values["PUBLIC_DIR"],
+		AssetsDir:       values["ASSETS_DIR"],
+		ExportDir:       values["EXPORT_DIR"],
+		ImportMaxBytes:  integer("IMPORT_MAX_BYTES"),
+		Media: MediaConfig{
+			Storage:           values["MEDIA_STORAGE"],
+			Dir:               values["MEDIA_DIR"],
+			MaxBytes:          integer("MEDIA_MAX_BYTES"),
+			S3Endpoint:        values["S3_ENDPOINT"],
+			S3Bucket:          values["S3_BUCKET"],
+			S3Region:          values["S3_REGION"],
+			S3AccessKeyId:     values["S3_ACCESS_KEY_ID"],
+			S3SecretAccessKey: values["S3_SECRET_ACCESS_KEY"],
+		},
+	}
+	if config.DatabaseUrl == "" && values["MYSQL_HOST"] != "" {
+		config.DatabaseUrl = (&url.URL{
+			Scheme: "mysql",
+			User:   url.UserPassword(values["MYSQL_USER"], values["MYSQL_PASSWORD"]),
+			Host:   values["MYSQL_HOST"] + ":" + values["MYSQL_PORT"],
+			Path:   "/" + values["MYSQL_DATABASE"],
+		}).String()
+	}
+	location, err := time.LoadLocation(values["TIMEZONE"])
+	if err != nil {
+		problems.add("TIMEZONE: unknown time zone %q", values["TIMEZONE"])
+	}
+	config.Location = location
+	if v := values["CREDENTIAL_KEY"]; v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			problems.add("CREDENTIAL_KEY: not valid base64: %v", err)
+		}
+		config.CredentialKey = key
+	}
+	config.SessionSecret = []byte(values["SESSION_SECRET"])
+	if config.DatabaseUrl == "" {
+		problems.add("DATABASE_URL: must be set, or MYSQL_HOST and the other MYSQL_* variables")
+	} else if !supportedDsn(config.DatabaseUrl) {
+		problems.add("DATABASE_URL: unsupported scheme. use mysql://, postgres:// or sqlite:")
+	}
+
+	// 読めなかった項目について、validateが同じ項目の別の問題を重ねて言わないようにする
+	if err := config.validate(); err != nil {
+		reported := map[string]bool{}
+		for _, problem := range problems.Problems {
+			reported[strings.SplitN(problem, ":", 2)[0]] = true
+		}
+		for _, problem := range err.(*ConfigError).Problems {
+			if !reported[strings.SplitN(problem, ":", 2)[0]] {
+				problems.Problems = append(problems.Problems, problem)
+			}
+		}
+	}
+	if len(problems.Problems) > 0 {
+		return config, problems
+	}
+	return config, nil
+}
+
+// NewServerに直接Configを渡したときのためにparseConfigとは別にしている
+// DBはStoreとして渡すので、DatabaseUrlはここでは見ない
+func (c Config) validate() error {
+	problems := &ConfigError{}
+	if c.Addr == "" {
+		problems.add("ADDR: must not be empty")
+	}
+	if u, err := url.Parse(c.BaseUrl); c.BaseUrl == "" {
+		problems.add("BASE_URL: must be set to the URL this server is reachable at")
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems.add("BASE_URL: %q is not an http or https URL", c.BaseUrl)
+	}
+	if c.Location == nil {
+		problems.add("TIMEZONE: must be set")
+	}
+	if c.CredentialKey == nil {
+		problems.add("CREDENTIAL_KEY: must be set to 32 random bytes in base64 (head -c 32 /dev/urandom | base64)")
+	} else if len(c.CredentialKey) != 32 {
+		problems.add("CREDENTIAL_KEY: must be 32 bytes, got %d", len(c.CredentialKey))
+	}
+	if len(c.SessionSecret) < 32 {
+		problems.add("SESSION_SECRET: must be set to at least 32 random characters (head -c 32 /dev/urandom | base64)")
+	}
+	if c.SyncInterval <= 0 {
+		problems.add("SYNC_INTERVAL: must be positive")
+	}
+	if c.RequestInterval < 0 {
+		problems.add("REQUEST_INTERVAL: must not be negative")
+	}
+	if c.OAuthClientName == "" {
+		problems.add("OAUTH_CLIENT_NAME: must not be empty")
+	}
+	if info, err := os.Stat(filepath.Join(c.PublicDir, "views")); err != nil || !info.IsDir() {
+		problems.add("PUBLIC_DIR: %s does not contain the views directory", c.PublicDir)
+	}
+	if c.ExportDir == "" {
+		problems.add("EXPORT_DIR: must not be empty")
+	}
+	if c.ImportMaxBytes <= 0 {
+		problems.add("IMPORT_MAX_BYTES: must be positive")
+	}
+	if c.Media.MaxBytes <= 0 {
+		problems.add("MEDIA_MAX_BYTES: must be positive")
+	}
+	switch c.Media.Storage {
+	case "local":
+		if c.Media.Dir == "" {
+			problems.add("MEDIA_DIR: must not be empty")
+		}
+	case "s3":
+		if c.Media.S3Endpoint == "" || c.Media.S3Bucket == "" || c.Media.S3AccessKeyId == "" || c.Media.S3SecretAccessKey == "" {
+			problems.add("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for MEDIA_STORAGE=s3")
+		}
+	default:
+		problems.add("MEDIA_STORAGE: must be local or s3, got %q", c.Media.Storage)
+	}
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// テストで時刻を固定できるようにする
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,50 @@
+package activitypublog
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir := t.TempDir()
+	config, err := parseConfig(testConfigValues(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SyncInterval != 30*time.Minute || config.Media.MaxBytes != 100*1024*1024 || config.Location.String() != "Asia/Tokyo" {
+		t.Errorf("config = %+v", config)
+	}
+
+	tests := []struct {
+		name     string
+		override map[string]string
+		want     []string
+	}{
+		{"not a duration", map[string]string{"SYNC_INTERVAL": "often"}, []string{`SYNC_INTERVAL: "often" is not a duration like 30m or 2s`}},
+		{"not an integer", map[string]string{"MEDIA_MAX_BYTES": "1MB"}, []string{`MEDIA_MAX_BYTES: "1MB" is not an integer`}},
+		{"not positive", map[string]string{"IMPORT_MAX_BYTES": "0"}, []string{"IMPORT_MAX_BYTES: must be positive"}},
+		{"short secret", map[string]string{"SESSION_SECRET": "secret"}, []string{"SESSION_SECRET: must be set to at least 32 random characters (head -c 32 /dev/urandom | base64)"}},
+		{"several", map[string]string{"BASE_URL": "ftp://example.com", "TIMEZONE": "Mars/Olympus"}, []string{
+			`TIMEZONE: unknown time zone "Mars/Olympus"`,
+			`BASE_URL: "ftp://example.com" is not an http or https URL`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := testConfigValues(dir)
+			for k, v := range tt.override {
+				values[k] = v
+			}
+			_, err := parseConfig(values)
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("err = %v, want ConfigError", err)
+			}
+			if !reflect.DeepEqual(configErr.Problems, tt.want) {
+				t.Errorf("problems = %q, want %q", configErr.Problems, tt.want)
+			}
+		})
+	}
+}
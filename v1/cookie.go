@@ -1,19 +1,142 @@
 package activitypublog
 
-import "github.com/labstack/echo/v4"
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const sessionCookieName = "session"
+const sessionLifetime = 24 * 7 * time.Hour
+
+func (s *Server) secureCookie() bool {
+	return strings.HasPrefix(s.config.BaseUrl, "https://")
+}
+
+// クッキーからセッションを引く。同じリクエスト内では結果を使い回す
+func (s *Server) LookupSession(c echo.Context) (Session, bool) {
+	if session, ok := c.Get("session").(Session); ok {
+		return session, true
+	}
+	sessionCookie, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return Session{}, false
+	}
+	id, ok := verifySigned(s.config.SessionSecret, sessionCookie.Value)
+	if !ok {
+		return Session{}, false
+	}
+	session, err := dSelectSession(c.Request().Context(), s.db, id, s.clock.Now())
+	if err != nil {
+		return Session{}, false
+	}
+	c.Set("session", session)
+	return session, true
+}
 
 // クライアントが非ログインならログインページにリダイレクトする
-// ログイン済みならtokenとhostを返す
-func RequireLoggedIn(c echo.Context) (string, string, error) {
-	tokenCookie, err := c.Cookie("token")
+// ログイン済みならセッションを返す
+func (s *Server) RequireLoggedIn(c echo.Context) (Session, error) {
+	session, ok := s.LookupSession(c)
+	if !ok {
+		return Session{}, c.Redirect(302, "/login")
+	}
+	return session, nil
+}
+
+// セッションを発行し、署名したIDだけをクッキーでクライアントに渡す
+func (s *Server) StartSession(c echo.Context, account Account, host string) error {
+	ctx := c.Request().Context()
+	if err := dDeleteExpiredSessions(ctx, s.db, s.clock.Now()); err != nil {
+		return err
+	}
+	id, err := randomString(32)
 	if err != nil {
-		return "", "", c.Redirect(302, "/login")
+		return err
 	}
-	token := tokenCookie.Value
-	hostCookie, err := c.Cookie("host")
+	csrfToken, err := randomString(32)
 	if err != nil {
-		return "", "", c.Redirect(302, "/login")
+		return err
+	}
+	now := s.clock.Now()
+	session := Session{
+		Id:          id,
+		AccountId:   account.Id,
+		Host:        host,
+		UserName:    account.UserName,
+		Acct:        account.Acct,
+		DisplayName: account.DisplayName,
+		Avatar:      account.Avatar,
+		Url:         account.Url,
+		CsrfToken:   csrfToken,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(sessionLifetime),
+	}
+	if err := dInsertSession(ctx, s.db, session); err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sign(s.config.SessionSecret, id),
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   s.secureCookie(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *Server) EndSession(c echo.Context, session Session) error {
+	if err := dDeleteSession(c.Request().Context(), s.db, session.Id); err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   s.secureCookie(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// ログイン中の本人の投稿かコレクションに入っている投稿か、公開設定で他人に見せてよい投稿ならtrue
+func (s *Server) CanViewStatus(c echo.Context, status Status) (bool, error) {
+	ctx := c.Request().Context()
+	if session, ok := s.LookupSession(c); ok && session.Host == status.Host {
+		if session.AccountId == status.AccountId && status.Source != StatusSourceCollection {
+			return true, nil
+		}
+		// お気に入りやブックマークした他人の投稿
+		ok, err := dCollectionsContainStatus(ctx, s.db, session.AccountId, session.Host, status.Id)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	// 誰かのコレクションから入れただけで、投稿者のアーカイブには入っていない
+	if status.Source == StatusSourceCollection {
+		return false, nil
+	}
+	account, err := s.store.SelectAccount(ctx, status.AccountId, status.Host)
+	// 投稿者がここにアーカイブを持っていない
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !account.Public || account.HideDeleted && !status.DeletedAt.IsZero() || !account.ShowReblogs && status.ReblogId != "" {
+		return false, nil
+	}
+	for _, visibility := range account.PublicVisibilities() {
+		if visibility == status.Visibility {
+			return true, nil
+		}
 	}
-	host := hostCookie.Value
-	return token, host, nil
+	return false, nil
 }
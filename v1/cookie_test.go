@@ -0,0 +1,117 @@
+package activitypublog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 署名がおかしいクッキーはDBを見る前に断る
+func TestRequireLoggedInRejectsUnsignedCookie(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"unsigned", &http.Cookie{Name: sessionCookieName, Value: "session-id"}},
+		{"other secret", &http.Cookie{Name: sessionCookieName, Value: sign([]byte("another secret"), "session-id")}},
+		{"tampered", &http.Cookie{Name: sessionCookieName, Value: "other-id" + sign(s.config.SessionSecret, "session-id")[len("session-id"):]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			if _, err := s.RequireLoggedIn(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/login" {
+				t.Errorf("response = %d %s, want a redirect to /login", rec.Code, rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+// StartSessionでログインし、発行したクッキーとセッションを返す
+func startTestSession(t *testing.T, s *Server) (*http.Cookie, Session) {
+	t.Helper()
+	account := Account{Id: "1", UserName: "alice", Host: testHost}
+	if _, err := s.store.InsertAccountIfNotExists(context.Background(), account.Id, account.UserName, testHost); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/authorize", nil), rec)
+	if err := s.StartSession(c, account, testHost); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+		t.Fatalf("cookies = %v, want the session cookie", cookies)
+	}
+	id, ok := verifySigned(s.config.SessionSecret, cookies[0].Value)
+	if !ok {
+		t.Fatalf("session cookie %q is not signed", cookies[0].Value)
+	}
+	session, err := dSelectSession(context.Background(), s.db, id, s.clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cookies[0], session
+}
+
+func TestSessionExpires(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(t, fixedClock{now})
+	cookie, session := startTestSession(t, s)
+	if session.AccountId != "1" || !session.ExpiresAt.Equal(now.Add(sessionLifetime)) {
+		t.Errorf("session = %+v", session)
+	}
+
+	lookup := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		_, ok := s.LookupSession(echo.New().NewContext(req, httptest.NewRecorder()))
+		return ok
+	}
+	s.clock = fixedClock{now.Add(sessionLifetime - time.Second)}
+	if !lookup() {
+		t.Error("session expired before its lifetime")
+	}
+	s.clock = fixedClock{now.Add(sessionLifetime)}
+	if lookup() {
+		t.Error("session is still valid after its lifetime")
+	}
+}
+
+// インスタンスのアプリが見つからずトークンを取り消せなくても、保存しているトークンとセッションは消す
+func TestLogoutDeletesCredential(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	cookie, session := startTestSession(t, s)
+	if err := dUpsertCredential(ctx, s.db, s.config.CredentialKey, "1", testHost, "token", "read", s.clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(csrfHeader, session.CsrfToken)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/login" {
+		t.Errorf("response = %d %s, want a redirect to /login", rec.Code, rec.Header().Get("Location"))
+	}
+	if _, err := dSelectCredentialToken(ctx, s.db, s.config.CredentialKey, "1", testHost); err == nil {
+		t.Error("credential was not deleted")
+	}
+	if _, err := dSelectSession(ctx, s.db, session.Id, s.clock.Now()); err == nil {
+		t.Error("session was not deleted")
+	}
+}
@@ -0,0 +1,66 @@
+package activitypublog
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptToken(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	encrypted, err := encryptToken(key, "secret token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains([]byte(encrypted), []byte("secret token")) {
+		t.Errorf("encrypted = %q contains the token", encrypted)
+	}
+	again, err := encryptToken(key, "secret token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encrypted {
+		t.Error("same ciphertext for the same token, want a random nonce")
+	}
+	decrypted, err := decryptToken(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret token" {
+		t.Errorf("decrypted = %q, want the token", decrypted)
+	}
+
+	if _, err := decryptToken(bytes.Repeat([]byte{2}, 32), encrypted); err == nil {
+		t.Error("decrypted with another key")
+	}
+	for _, broken := range []string{"", "not base64!", "AAAA", encrypted[:len(encrypted)-4] + "AAAA"} {
+		if _, err := decryptToken(key, broken); err == nil {
+			t.Errorf("decryptToken(%q) succeeded", broken)
+		}
+	}
+}
+
+func TestVerifySigned(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	signed := sign(secret, "session.id")
+	tests := []struct {
+		name   string
+		signed string
+		want   string
+		ok     bool
+	}{
+		{"valid", signed, "session.id", true},
+		{"other secret", sign([]byte("another secret"), "session.id"), "", false},
+		{"tampered value", "session.other" + signed[len("session.id"):], "", false},
+		{"tampered signature", signed[:len(signed)-1] + "A", "", false},
+		{"no signature", "session", "", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := verifySigned(secret, tt.signed)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("verifySigned(%q) = %q, %v, want %q, %v", tt.signed, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
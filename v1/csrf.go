@@ -0,0 +1,89 @@
+package activitypublog
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const csrfFormField = "_csrf"
+const csrfHeader = "X-CSRF-Token"
+const csrfCookieName = "csrf"
+
+// ログイン済みならセッションごとのトークンを使う
+// ログイン前(/sign_in)は署名付きクッキーに持たせたトークンを使う
+func (s *Server) csrfTokenFor(c echo.Context) (string, error) {
+	if session, ok := s.LookupSession(c); ok {
+		return session.CsrfToken, nil
+	}
+	if cookie, err := c.Cookie(csrfCookieName); err == nil {
+		if token, ok := verifySigned(s.config.SessionSecret, cookie.Value); ok {
+			return token, nil
+		}
+	}
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     csrfCookieName,
+		Value:    sign(s.config.SessionSecret, token),
+		Path:     "/",
+		Expires:  s.clock.Now().Add(sessionLifetime),
+		HttpOnly: true,
+		Secure:   s.secureCookie(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+// GET以外のリクエストはフォームの_csrfかX-CSRF-Tokenヘッダーがトークンと一致しなければ拒否する
+// GETではRendererがフォームを埋め込むときに初めてトークンを調べる。フォームのないページやフィード、メディアでは
+// セッションを引いたりクッキーを発行したりしないので、レスポンスにSet-Cookieが付かない
+// APIトークンで認証するリクエストはクッキーを使わないので対象外
+func (s *Server) CSRF() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := bearerToken(c); ok {
+				return next(c)
+			}
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				var token string
+				var err error
+				looked := false
+				c.Set("csrf", func() (string, error) {
+					if !looked {
+						token, err = s.csrfTokenFor(c)
+						looked = true
+					}
+					return token, err
+				})
+				return next(c)
+			}
+			token, err := s.csrfTokenFor(c)
+			if err != nil {
+				return HandlerError(c.Request().Method, c.Path(), c)(err)
+			}
+			c.Set("csrf", func() (string, error) { return token, nil })
+			sent := c.Request().Header.Get(csrfHeader)
+			if sent == "" {
+				sent = c.FormValue(csrfFormField)
+			}
+			if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				return c.String(http.StatusForbidden, "invalid csrf token")
+			}
+			return next(c)
+		}
+	}
+}
+
+// Rendererから呼ぶ。CSRFを通っていないリクエストでは空
+func csrfTokenOf(c echo.Context) (string, error) {
+	token, ok := c.Get("csrf").(func() (string, error))
+	if !ok {
+		return "", nil
+	}
+	return token()
+}
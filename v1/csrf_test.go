@@ -0,0 +1,111 @@
+package activitypublog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CSRFを通ったらフォームを描くときと同じようにトークンを調べるハンドラーで、リクエストを1つ処理する
+func serveCSRF(t *testing.T, s *Server, req *http.Request, session *Session) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if session != nil {
+		c.Set("session", *session)
+	}
+	token := ""
+	err := s.CSRF()(func(c echo.Context) error {
+		var err error
+		token, err = csrfTokenOf(c)
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec, token
+}
+
+func csrfForm(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{csrfFormField: {token}}.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	return req
+}
+
+func TestCSRFBeforeLogin(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec, token := serveCSRF(t, s, httptest.NewRequest(http.MethodGet, "/login", nil), nil)
+	if rec.Code != http.StatusNoContent || token == "" {
+		t.Fatalf("GET = %d with token %q, want the token in the context", rec.Code, token)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatalf("cookies = %v, want the signed csrf cookie", cookies)
+	}
+	cookie := cookies[0]
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		want   int
+	}{
+		{"matching token", cookie, token, http.StatusNoContent},
+		{"no token", cookie, "", http.StatusForbidden},
+		{"wrong token", cookie, "wrong", http.StatusForbidden},
+		{"no cookie", nil, token, http.StatusForbidden},
+		{"cookie signed by another secret", &http.Cookie{Name: csrfCookieName, Value: sign([]byte("another secret"), token)}, token, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := csrfForm(tt.token)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			if rec, _ := serveCSRF(t, s, req, nil); rec.Code != tt.want {
+				t.Errorf("POST = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFLoggedIn(t *testing.T) {
+	s := newTestServer(t, nil)
+	session := &Session{Id: "session-id", CsrfToken: "session-token"}
+	rec, token := serveCSRF(t, s, httptest.NewRequest(http.MethodGet, "/", nil), session)
+	if token != "session-token" {
+		t.Errorf("token = %q, want the session's token", token)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("cookies = %v, want none for a logged-in user", cookies)
+	}
+	if rec, _ := serveCSRF(t, s, csrfForm("session-token"), session); rec.Code != http.StatusNoContent {
+		t.Errorf("POST with the session's token = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec, _ := serveCSRF(t, s, csrfForm("other-token"), session); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with another token = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// フォームを描かないページではセッションもクッキーも触らない
+func TestCSRFWithoutForm(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/feed.atom", nil), rec)
+	err := s.CSRF()(func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("cookies = %v, want none", cookies)
+	}
+}
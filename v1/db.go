@@ -1,204 +1,755 @@
 package activitypublog
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
 )
 
-func ConvertCreatedAtToTokyo(statuses []Status) []Status {
-	location, _ := time.LoadLocation("Asia/Tokyo")
+func ConvertCreatedAtToUTC(statuses []Status) []Status {
 	for i, v := range statuses {
-		statuses[i].CreatedAt = v.CreatedAt.In(location)
+		statuses[i].CreatedAt = v.CreatedAt.UTC()
 	}
 	return statuses
 }
 
-func ConvertCreatedAtToUTC(statuses []Status) []Status {
-	for i, v := range statuses {
-		statuses[i].CreatedAt = v.CreatedAt.UTC()
+func dInsertSyncStateIfNotExists(ctx context.Context, db bun.IDB, accountId string, host string, nextRunAt time.Time) error {
+	state := SyncState{AccountId: accountId, Host: host, NextRunAt: nextRunAt.UTC()}
+	_, err := db.NewInsert().Model(&state).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dInsertSyncStateIfNotExists: %v", err)
 	}
-	return statuses
+	return nil
 }
 
-func dSelectAppByHost(host string) (App, error) {
-	var app App
-	err := bundb.NewSelect().Model(&app).Where("host = ?", host).Scan(ctx)
+func dSelectSyncState(ctx context.Context, db bun.IDB, accountId string, host string) (SyncState, error) {
+	var state SyncState
+	err := db.NewSelect().Model(&state).Where("account_id = ? AND host = ?", accountId, host).Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return state, fmt.Errorf("dSelectSyncState: %v", err)
+	}
+	return state, nil
+}
+
+// 認証情報を保存しているアカウントのうち、同期予定時刻を過ぎたものを返す
+func dSelectDueSyncStates(ctx context.Context, db bun.IDB, now time.Time) ([]SyncState, error) {
+	var states []SyncState
+	err := db.NewSelect().
+		Model(&states).
+		Join("INNER JOIN credential").
+		JoinOn("sync_state.account_id = credential.account_id AND sync_state.host = credential.host").
+		Where("sync_state.next_run_at <= ?", now.UTC()).
+		Order("sync_state.next_run_at ASC").
+		Scan(ctx)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return app, fmt.Errorf("no app for hostname: %s", host)
-		}
-		return app, fmt.Errorf("unknown db error: %v", err)
+		return nil, fmt.Errorf("dSelectDueSyncStates: %v", err)
 	}
-	return app, nil
+	return states, nil
 }
 
-func dInsertApp(app App) error {
-	_, err := bundb.NewInsert().Model(&app).Exec(ctx)
+func dUpdateSyncStateNextRunAt(ctx context.Context, db bun.IDB, accountId string, host string, nextRunAt time.Time) error {
+	_, err := db.NewUpdate().Model(&SyncState{NextRunAt: nextRunAt.UTC()}).Column("next_run_at").Where("account_id = ? AND host = ?", accountId, host).Exec(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create app: %v", err)
+		return fmt.Errorf("dUpdateSyncStateNextRunAt: %v", err)
 	}
 	return nil
 }
 
-func dInsertStatuses(statuses []Status, accountId string, host string) (int64, error) {
-	if len(statuses) == 0 {
-		return 0, nil
+func dUpdateSyncStateFinished(ctx context.Context, db bun.IDB, accountId string, host string, lastRunAt time.Time, nextRunAt time.Time, lastError string) error {
+	state := SyncState{LastRunAt: lastRunAt.UTC(), NextRunAt: nextRunAt.UTC(), LastError: lastError}
+	_, err := db.NewUpdate().Model(&state).Column("last_run_at", "next_run_at", "last_error").Where("account_id = ? AND host = ?", accountId, host).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dUpdateSyncStateFinished: %v", err)
+	}
+	return nil
+}
+
+func dUpsertCredential(ctx context.Context, db bun.IDB, key []byte, accountId string, host string, token string, scope string, createdAt time.Time) error {
+	encrypted, err := encryptToken(key, token)
+	if err != nil {
+		return err
 	}
-	statuses = ConvertCreatedAtToUTC(statuses)
-	res, err := bundb.NewInsert().Model(&statuses).Exec(ctx)
+	credential := Credential{AccountId: accountId, Host: host, EncryptedToken: encrypted, Scope: scope, CreatedAt: createdAt.UTC()}
+	q := db.NewInsert().Model(&credential)
+	// MySQLとPostgreSQL・SQLiteで構文が違う
+	if db.Dialect().Name() == dialect.MySQL {
+		q = q.On("DUPLICATE KEY UPDATE").Set("encrypted_token = VALUES(encrypted_token)").Set("scope = VALUES(scope)").Set("created_at = VALUES(created_at)")
+	} else {
+		q = q.On("CONFLICT (account_id, host) DO UPDATE").Set("encrypted_token = EXCLUDED.encrypted_token").Set("scope = EXCLUDED.scope").Set("created_at = EXCLUDED.created_at")
+	}
+	_, err = q.Exec(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert statuses: %v", err)
+		return fmt.Errorf("dUpsertCredential: %v", err)
 	}
-	rowsAffected, err := res.RowsAffected()
+	return nil
+}
+
+// 復号済みのトークンを返す
+func dSelectCredentialToken(ctx context.Context, db bun.IDB, key []byte, accountId string, host string) (string, error) {
+	var credential Credential
+	err := db.NewSelect().Model(&credential).Where("account_id = ? AND host = ?", accountId, host).Scan(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get insert result: %v", err)
+		return "", fmt.Errorf("dSelectCredentialToken: %v", err)
 	}
-	return rowsAffected, nil
+	return decryptToken(key, credential.EncryptedToken)
 }
 
-func execSelectSingleStatusId(query string, accountId string) (string, error) {
-	var id string
-	row := db.QueryRow(query, accountId)
-	if err := row.Scan(&id); err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
+// トークンは復号しない
+func dSelectCredentialAccounts(ctx context.Context, db bun.IDB) ([]Credential, error) {
+	var credentials []Credential
+	err := db.NewSelect().Model(&credentials).Column("account_id", "host").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectCredentialAccounts: %v", err)
+	}
+	return credentials, nil
+}
+
+func dInsertSession(ctx context.Context, db bun.IDB, session Session) error {
+	session.CreatedAt = session.CreatedAt.UTC()
+	session.ExpiresAt = session.ExpiresAt.UTC()
+	_, err := db.NewInsert().Model(&session).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dInsertSession: %v", err)
+	}
+	return nil
+}
+
+// 期限切れのセッションは存在しないものとして扱う
+func dSelectSession(ctx context.Context, db bun.IDB, id string, now time.Time) (Session, error) {
+	var session Session
+	err := db.NewSelect().Model(&session).Where("id = ? AND expires_at > ?", id, now.UTC()).Scan(ctx)
+	if err != nil {
+		return session, fmt.Errorf("dSelectSession: %v", err)
+	}
+	return session, nil
+}
+
+func dDeleteExpiredSessions(ctx context.Context, db bun.IDB, now time.Time) error {
+	_, err := db.NewDelete().Model((*Session)(nil)).Where("expires_at <= ?", now.UTC()).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dDeleteExpiredSessions: %v", err)
+	}
+	return nil
+}
+
+func dDeleteCredential(ctx context.Context, db bun.IDB, accountId string, host string) error {
+	_, err := db.NewDelete().Model((*Credential)(nil)).Where("account_id = ? AND host = ?", accountId, host).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dDeleteCredential: %v", err)
+	}
+	return nil
+}
+
+func dDeleteSession(ctx context.Context, db bun.IDB, id string) error {
+	_, err := db.NewDelete().Model((*Session)(nil)).Where("id = ?", id).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dDeleteSession: %v", err)
+	}
+	return nil
+}
+
+func insertMediaAttachments(ctx context.Context, db bun.IDB, attachments []MediaAttachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	_, err := db.NewInsert().Model(&attachments).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("insertMediaAttachments: %v", err)
+	}
+	return nil
+}
+
+// ブーストでない投稿は飛ばす
+func insertReblogs(ctx context.Context, db bun.IDB, statuses []Status) error {
+	var reblogs []Reblog
+	for _, status := range statuses {
+		if status.Reblog != nil {
+			reblog := *status.Reblog
+			reblog.CreatedAt = reblog.CreatedAt.UTC()
+			reblogs = append(reblogs, reblog)
 		}
-		return "", fmt.Errorf("failed to select status: %v", err)
 	}
-	return id, nil
+	if len(reblogs) == 0 {
+		return nil
+	}
+	_, err := db.NewInsert().Model(&reblogs).Ignore().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("insertReblogs: %v", err)
+	}
+	return nil
+}
+
+func dSelectPendingMediaAttachments(ctx context.Context, db bun.IDB, accountId string, host string, maxAttempts int) ([]MediaAttachment, error) {
+	var attachments []MediaAttachment
+	err := db.NewSelect().
+		Model(&attachments).
+		Join("INNER JOIN status").
+		JoinOn("media_attachment.status_id = status.id AND media_attachment.host = status.host").
+		Where("status.host = ?", host).
+		// お気に入りとブックマークした他人の投稿のメディアも保存する
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("status.account_id = ? AND status.source != ?", accountId, StatusSourceCollection).
+				WhereOr("EXISTS (SELECT 1 FROM collection_item WHERE collection_item.status_id = status.id AND collection_item.host = status.host AND collection_item.account_id = ?)", accountId)
+		}).
+		// 元のファイルかプレビューのどちらかが保存できていないもの
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("media_attachment.blob_hash = ''").
+				WhereOr("media_attachment.preview_remote_url != '' AND media_attachment.preview_blob_hash = ''")
+		}).
+		Where("media_attachment.fetch_attempts < ?", maxAttempts).
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectPendingMediaAttachments: %v", err)
+	}
+	return attachments, nil
+}
+
+func dUpdateMediaAttachmentBlob(ctx context.Context, db bun.IDB, attachment MediaAttachment) error {
+	_, err := db.NewUpdate().
+		Model(&attachment).
+		Column("blob_hash", "content_type", "preview_blob_hash", "preview_content_type", "fetch_attempts", "fetch_error").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dUpdateMediaAttachmentBlob: %v", err)
+	}
+	return nil
 }
 
-func dSelectNewestStatusIdByAccount(accoutId string) (string, error) {
-	return execSelectSingleStatusId("SELECT id FROM status WHERE account_id = ? ORDER BY id DESC LIMIT 1", accoutId)
+// statusesが空なら何も返さない。条件がないと全件を返してしまうので先に戻る
+func dSelectMediaAttachmentsByStatuses(ctx context.Context, db bun.IDB, statuses []Status) ([]MediaAttachment, error) {
+	var attachments []MediaAttachment
+	if len(statuses) == 0 {
+		return attachments, nil
+	}
+	idsByHost := map[string][]string{}
+	for _, status := range statuses {
+		idsByHost[status.Host] = append(idsByHost[status.Host], status.Id)
+	}
+	q := db.NewSelect().Model(&attachments)
+	for host, ids := range idsByHost {
+		q = q.WhereOr("host = ? AND status_id IN (?)", host, bun.In(ids))
+	}
+	if err := q.Order("id ASC").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("dSelectMediaAttachmentsByStatuses: %v", err)
+	}
+	return attachments, nil
 }
 
-func dSelectOldestStatusIdByAccount(accoutId string) (string, error) {
-	return execSelectSingleStatusId("SELECT id FROM status WHERE account_id = ? ORDER BY id ASC LIMIT 1", accoutId)
+func dSelectReblogsByStatuses(ctx context.Context, db bun.IDB, statuses []Status) ([]Reblog, error) {
+	var reblogs []Reblog
+	idsByHost := map[string][]string{}
+	for _, status := range statuses {
+		if status.ReblogId != "" {
+			idsByHost[status.Host] = append(idsByHost[status.Host], status.Id)
+		}
+	}
+	if len(idsByHost) == 0 {
+		return reblogs, nil
+	}
+	q := db.NewSelect().Model(&reblogs)
+	for host, ids := range idsByHost {
+		q = q.WhereOr("host = ? AND status_id IN (?)", host, bun.In(ids))
+	}
+	if err := q.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("dSelectReblogsByStatuses: %v", err)
+	}
+	return reblogs, nil
 }
 
-func dSelectStatusesByAccountAndText(accountId string, includedText string) ([]Status, error) {
-	var res []Status
+// 写しがまだないブーストを古い順に返す。写しを作るのに使うRawも読む
+func dSelectReblogsWithoutSnapshot(ctx context.Context, db bun.IDB, limit int) ([]Status, error) {
+	var statuses []Status
+	err := db.NewSelect().Model(&statuses).
+		Column("id", "host", "account_id", "reblog_id", "raw").
+		Where("COALESCE(status.reblog_id, '') != ''").
+		Where("NOT EXISTS (SELECT 1 FROM reblog WHERE reblog.status_id = status.id AND reblog.host = status.host)").
+		Order("status.id ASC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectReblogsWithoutSnapshot: %v", err)
+	}
+	return statuses, nil
+}
 
-	rows, err := db.Query("SELECT id, text, url, created_at FROM status WHERE account_id = ? AND text LIKE CONCAT('%', ?, '%') ORDER BY id DESC", accountId, includedText)
+// ハッシュが同じファイルは内容も同じなので、どれか1つの添付を返せばよい
+// 閲覧できるかどうかの判断のために、添付されている投稿と投稿者も返す
+func dSelectMediaByBlobHash(ctx context.Context, db bun.IDB, hash string) ([]MediaAttachment, []Status, error) {
+	var attachments []MediaAttachment
+	err := db.NewSelect().Model(&attachments).Where("blob_hash = ? OR preview_blob_hash = ?", hash, hash).Scan(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("query failed: %v", err)
+		return nil, nil, fmt.Errorf("dSelectMediaByBlobHash: %v", err)
 	}
-	defer rows.Close()
-	for rows.Next() {
+	var statuses []Status
+	for _, attachment := range attachments {
 		var status Status
-		if err := rows.Scan(&status.Id, &status.Text, &status.Url, &status.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan failed: %v", err)
+		err := db.NewSelect().Model(&status).Column("id", "host", "account_id", "visibility", "deleted_at", "reblog_id", "source").Where("id = ? AND host = ?", attachment.StatusId, attachment.Host).Scan(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dSelectMediaByBlobHash: %v", err)
+		}
+		statuses = append(statuses, status)
+	}
+	return attachments, statuses, nil
+}
+
+func normalizeTagName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, "#"))
+}
+
+func insertStatusTags(ctx context.Context, db bun.IDB, statuses []Status) error {
+	var tags []Tag
+	var statusTags []StatusTag
+	for _, status := range statuses {
+		for _, tag := range status.Tags {
+			name := normalizeTagName(tag.Name)
+			if name == "" {
+				continue
+			}
+			tags = append(tags, Tag{Name: name})
+			statusTags = append(statusTags, StatusTag{StatusId: status.Id, Host: status.Host, TagName: name})
 		}
-		res = append(res, status)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows included error: %v", err)
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := db.NewInsert().Model(&tags).Ignore().Exec(ctx); err != nil {
+		return fmt.Errorf("insertStatusTags: %v", err)
+	}
+	if _, err := db.NewInsert().Model(&statusTags).Ignore().Exec(ctx); err != nil {
+		return fmt.Errorf("insertStatusTags: %v", err)
 	}
+	return nil
+}
 
-	statuses := ConvertCreatedAtToTokyo(res)
-	return statuses, nil
+// 古い版から順に返す
+func dSelectStatusRevisions(ctx context.Context, db bun.IDB, statusId string, host string) ([]StatusRevision, error) {
+	revisions := []StatusRevision{}
+	err := db.NewSelect().Model(&revisions).Where("status_id = ? AND host = ?", statusId, host).Order("replaced_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectStatusRevisions: %v", err)
+	}
+	return revisions, nil
+}
+
+func dSelectStatusesByAccountAndTag(ctx context.Context, db bun.IDB, accountId string, host string, tag string, page PageParams) (Page, error) {
+	var statuses []Status
+	q := db.NewSelect().
+		Model(&statuses).
+		ExcludeColumn("raw").
+		Join("INNER JOIN status_tag").
+		JoinOn("status_tag.status_id = status.id AND status_tag.host = status.host").
+		Where("status.account_id = ? AND status.host = ? AND status.source != ?", accountId, host, StatusSourceCollection).
+		Where("status_tag.tag_name = ?", normalizeTagName(tag))
+	p, err := selectPage(ctx, q, &statuses, page, "status.id")
+	if err != nil {
+		return p, fmt.Errorf("dSelectStatusesByAccountAndTag: %v", err)
+	}
+	return p, nil
+}
+
+// visibilitiesがnilなら公開範囲で絞り込まない
+// excludeDeletedならインスタンスで削除された投稿を数えない
+func dSelectTagCounts(ctx context.Context, db bun.IDB, accountId string, host string, visibilities []string, excludeDeleted bool) ([]TagCount, error) {
+	var counts []TagCount
+	q := db.NewSelect().
+		TableExpr("status_tag").
+		ColumnExpr("status_tag.tag_name AS name").
+		ColumnExpr("COUNT(*) AS count").
+		Join("INNER JOIN status").
+		JoinOn("status_tag.status_id = status.id AND status_tag.host = status.host").
+		Where("status.account_id = ? AND status.host = ? AND status.source != ?", accountId, host, StatusSourceCollection)
+	if visibilities != nil {
+		q = q.Where("status.visibility IN (?)", bun.In(visibilities))
+	}
+	if excludeDeleted {
+		q = q.Where("status.deleted_at IS NULL")
+	}
+	err := q.GroupExpr("status_tag.tag_name").OrderExpr("count DESC, name ASC").Scan(ctx, &counts)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectTagCounts: %v", err)
+	}
+	return counts, nil
 }
 
-func dInsertAccountIfNotExists(id string, username string, host string) (int64, error) {
-	res, err := db.Exec("INSERT INTO account SELECT * FROM (SELECT ? as c1, ? as c2, ? as c3, ? as c4, ? as c5, ? as c6, ? as c7, false) AS tmp WHERE NOT EXISTS (SELECT id FROM account WHERE id = ?) LIMIT 1", id, host, username, false, false, false, false, id)
+func dSelectStatusTagsByStatuses(ctx context.Context, db bun.IDB, statuses []Status) ([]StatusTag, error) {
+	var statusTags []StatusTag
+	if len(statuses) == 0 {
+		return statusTags, nil
+	}
+	idsByHost := map[string][]string{}
+	for _, status := range statuses {
+		idsByHost[status.Host] = append(idsByHost[status.Host], status.Id)
+	}
+	q := db.NewSelect().Model(&statusTags)
+	for host, ids := range idsByHost {
+		q = q.WhereOr("host = ? AND status_id IN (?)", host, bun.In(ids))
+	}
+	if err := q.Order("tag_name ASC").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("dSelectStatusTagsByStatuses: %v", err)
+	}
+	return statusTags, nil
+}
+
+func dInsertApiToken(ctx context.Context, db bun.IDB, token ApiToken) error {
+	token.CreatedAt = token.CreatedAt.UTC()
+	_, err := db.NewInsert().Model(&token).Exec(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert account: %v", err)
+		return fmt.Errorf("dInsertApiToken: %v", err)
 	}
-	rowsAffected, err := res.RowsAffected()
+	return nil
+}
+
+func dSelectApiTokenByHash(ctx context.Context, db bun.IDB, hash string) (ApiToken, error) {
+	var token ApiToken
+	err := db.NewSelect().Model(&token).Where("token_hash = ?", hash).Scan(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get insert result: %v", err)
+		return token, fmt.Errorf("dSelectApiTokenByHash: %v", err)
 	}
-	return rowsAffected, nil
+	return token, nil
 }
 
-func dSelectAccountAllFetchedById(accountId string, host string) (bool, error) {
-	var account Account
-	err := bundb.NewSelect().Model(&account).Column("all_fetched").Where("id = ? AND host = ?", accountId, host).Scan(ctx)
+func dSelectApiTokens(ctx context.Context, db bun.IDB, accountId string, host string) ([]ApiToken, error) {
+	var tokens []ApiToken
+	err := db.NewSelect().Model(&tokens).Where("account_id = ? AND host = ?", accountId, host).Order("created_at ASC").Scan(ctx)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, fmt.Errorf("dSelectAccountAllFetchedById: %v", err)
+		return nil, fmt.Errorf("dSelectApiTokens: %v", err)
 	}
-	return account.AllFetched, nil
+	return tokens, nil
 }
 
-func dUpdateAccountAllFetched(accountId string) error {
-	_, err := bundb.NewUpdate().Model(&Account{AllFetched: true}).Column("all_fetched").Where("id = ?", accountId).Exec(ctx)
+func dUpdateApiTokenLastUsedAt(ctx context.Context, db bun.IDB, id string, lastUsedAt time.Time) error {
+	_, err := db.NewUpdate().Model(&ApiToken{LastUsedAt: lastUsedAt.UTC()}).Column("last_used_at").Where("id = ?", id).Exec(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("dUpdateApiTokenLastUsedAt: %v", err)
 	}
 	return nil
 }
 
-func dUpdateAccountPublic(accountId string, host string, public bool) error {
-	_, err := bundb.NewUpdate().Model(&Account{Public: public}).Column("public").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
+// 他人のトークンは消せない。消したらtrueを返す
+func dDeleteApiToken(ctx context.Context, db bun.IDB, id string, accountId string, host string) (bool, error) {
+	res, err := db.NewDelete().Model((*ApiToken)(nil)).Where("id = ? AND account_id = ? AND host = ?", id, accountId, host).Exec(ctx)
 	if err != nil {
-		return err
+		return false, fmt.Errorf("dDeleteApiToken: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("dDeleteApiToken: %v", err)
+	}
+	return n > 0, nil
+}
+
+func dInsertExportJob(ctx context.Context, db bun.IDB, job ExportJob) error {
+	job.CreatedAt = job.CreatedAt.UTC()
+	_, err := db.NewInsert().Model(&job).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dInsertExportJob: %v", err)
 	}
 	return nil
 }
 
-func dSelectAccount(accountId string, host string) (Account, error) {
-	var account Account
-	err := bundb.NewSelect().Model(&account).Where("id = ? AND host = ?", accountId, host).Scan(ctx)
+func dSelectExportJob(ctx context.Context, db bun.IDB, id string, accountId string, host string) (ExportJob, error) {
+	var job ExportJob
+	err := db.NewSelect().Model(&job).Where("id = ? AND account_id = ? AND host = ?", id, accountId, host).Scan(ctx)
+	if err == sql.ErrNoRows {
+		return job, ErrNotFound
+	}
 	if err != nil {
-		return account, fmt.Errorf("dSelectAccount: %v", err)
+		return job, fmt.Errorf("dSelectExportJob: %v", err)
+	}
+	return job, nil
+}
+
+// まだ一度もエクスポートしていなければIdが空のジョブを返す
+func dSelectLatestExportJob(ctx context.Context, db bun.IDB, accountId string, host string) (ExportJob, error) {
+	var job ExportJob
+	err := db.NewSelect().Model(&job).Where("account_id = ? AND host = ?", accountId, host).Order("created_at DESC").Limit(1).Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return job, fmt.Errorf("dSelectLatestExportJob: %v", err)
 	}
-	return account, nil
+	return job, nil
 }
 
-func dSelectAccountByUserName(username string, host string) (Account, error) {
-	var account Account
-	err := bundb.NewSelect().Model(&account).Where("user_name = ? AND host = ?", username, host).Scan(ctx)
+func dSelectExportJobs(ctx context.Context, db bun.IDB, accountId string, host string) ([]ExportJob, error) {
+	var jobs []ExportJob
+	err := db.NewSelect().Model(&jobs).Where("account_id = ? AND host = ?", accountId, host).Order("created_at ASC").Scan(ctx)
 	if err != nil {
-		return account, fmt.Errorf("dSelectAccountByUserName: %v", err)
+		return nil, fmt.Errorf("dSelectExportJobs: %v", err)
 	}
-	return account, nil
+	return jobs, nil
 }
 
-func dUpdateAccountVisibility(accountId string, host string, showUnlisted bool, showPrivate bool, showDirect bool) error {
-	_, err := bundb.NewUpdate().Model(&Account{ShowUnlisted: showUnlisted, ShowPrivate: showPrivate, ShowDirect: showDirect}).Column("show_unlisted", "show_private", "show_direct").Where("id = ?", accountId).Where("host = ?", host).Exec(ctx)
+func dSelectUnfinishedExportJobs(ctx context.Context, db bun.IDB) ([]ExportJob, error) {
+	var jobs []ExportJob
+	err := db.NewSelect().Model(&jobs).Where("state IN (?)", bun.In([]string{ExportQueued, ExportRunning})).Order("created_at ASC").Scan(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("dSelectUnfinishedExportJobs: %v", err)
+	}
+	return jobs, nil
+}
+
+func dUpdateExportJob(ctx context.Context, db bun.IDB, job ExportJob) error {
+	job.FinishedAt = job.FinishedAt.UTC()
+	_, err := db.NewUpdate().Model(&job).Column("state", "status_count", "size", "error", "finished_at").WherePK().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dUpdateExportJob: %v", err)
+	}
+	return nil
+}
+
+func dDeleteExportJob(ctx context.Context, db bun.IDB, id string) error {
+	_, err := db.NewDelete().Model((*ExportJob)(nil)).Where("id = ?", id).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dDeleteExportJob: %v", err)
 	}
 	return nil
 }
 
-func dSelectStatusesByAccountWithRestriction(username string, host string) ([]Status, error) {
-	var account Account
-	err := bundb.NewSelect().Model(&account).Column("show_unlisted", "show_private", "show_direct").Where("user_name = ? AND host = ?", username, host).Scan(ctx)
+func dInsertSyncJob(ctx context.Context, db bun.IDB, job SyncJob) error {
+	job.CreatedAt = job.CreatedAt.UTC()
+	job.UpdatedAt = job.UpdatedAt.UTC()
+	_, err := db.NewInsert().Model(&job).Exec(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("visibitily query failed: %v", err)
+		return fmt.Errorf("dInsertSyncJob: %v", err)
 	}
+	return nil
+}
 
-	var visibilities []string = []string{"public"}
-	if account.ShowUnlisted {
-		visibilities = append(visibilities, "unlisted")
+func dSelectSyncJob(ctx context.Context, db bun.IDB, id string, accountId string, host string) (SyncJob, error) {
+	var job SyncJob
+	err := db.NewSelect().Model(&job).Where("id = ? AND account_id = ? AND host = ?", id, accountId, host).Scan(ctx)
+	if err == sql.ErrNoRows {
+		return job, ErrNotFound
 	}
-	if account.ShowPrivate {
-		visibilities = append(visibilities, "private")
+	if err != nil {
+		return job, fmt.Errorf("dSelectSyncJob: %v", err)
 	}
-	if account.ShowDirect {
-		visibilities = append(visibilities, "direct")
+	return job, nil
+}
+
+// その種類のジョブがなければゼロ値を返す
+func dSelectLatestSyncJobOfKind(ctx context.Context, db bun.IDB, accountId string, host string, kind string) (SyncJob, error) {
+	var job SyncJob
+	err := db.NewSelect().Model(&job).Where("account_id = ? AND host = ? AND kind = ?", accountId, host, kind).Order("created_at DESC").Limit(1).Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return job, fmt.Errorf("dSelectLatestSyncJobOfKind: %v", err)
 	}
+	return job, nil
+}
 
-	var statuses []Status
+// ジョブがなければゼロ値を返す
+func dSelectLatestSyncJob(ctx context.Context, db bun.IDB, accountId string, host string) (SyncJob, error) {
+	var job SyncJob
+	err := db.NewSelect().Model(&job).Where("account_id = ? AND host = ?", accountId, host).Order("created_at DESC").Limit(1).Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return job, fmt.Errorf("dSelectLatestSyncJob: %v", err)
+	}
+	return job, nil
+}
+
+func dSelectUnfinishedSyncJobs(ctx context.Context, db bun.IDB) ([]SyncJob, error) {
+	var jobs []SyncJob
+	err := db.NewSelect().Model(&jobs).Where("state IN (?)", bun.In([]string{SyncJobQueued, SyncJobRunning})).Order("created_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectUnfinishedSyncJobs: %v", err)
+	}
+	return jobs, nil
+}
+
+func dSelectSyncJobState(ctx context.Context, db bun.IDB, id string) (string, error) {
+	var state string
+	err := db.NewSelect().Model((*SyncJob)(nil)).Column("state").Where("id = ?", id).Scan(ctx, &state)
+	if err != nil {
+		return "", fmt.Errorf("dSelectSyncJobState: %v", err)
+	}
+	return state, nil
+}
 
-	err = bundb.NewSelect().
+// stateは変えない。止められたジョブを進み具合の保存で上書きしないようにする
+func dUpdateSyncJobProgress(ctx context.Context, db bun.IDB, job SyncJob) error {
+	job.UpdatedAt = job.UpdatedAt.UTC()
+	_, err := db.NewUpdate().Model(&job).Column("pages", "status_count", "oldest_id", "deleted_count", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("dUpdateSyncJobProgress: %v", err)
+	}
+	return nil
+}
+
+// stateがfromのどれかのときだけtoにする。変えたらtrueを返す
+// 止めたジョブをワーカーが上書きしたり、同じジョブを二重に再開したりしないようにする
+func dUpdateSyncJobStateIf(ctx context.Context, db bun.IDB, id string, from []string, to string, errString string, now time.Time) (bool, error) {
+	q := db.NewUpdate().Model((*SyncJob)(nil)).
+		Set("state = ?", to).
+		Set("error = ?", errString).
+		Set("updated_at = ?", now.UTC()).
+		Where("id = ? AND state IN (?)", id, bun.In(from))
+	if to == SyncJobQueued || to == SyncJobRunning {
+		q = q.Set("finished_at = NULL")
+	} else {
+		q = q.Set("finished_at = ?", now.UTC())
+	}
+	res, err := q.Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("dUpdateSyncJobStateIf: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("dUpdateSyncJobStateIf: %v", err)
+	}
+	return n > 0, nil
+}
+
+// oldestIdからnewestIdまで(両端を含む)の、APIから取り込んで削除済みにしていない投稿のID
+// oldestIdが空なら一番古い投稿から
+func dSelectReconcileStatusIds(ctx context.Context, db bun.IDB, accountId string, host string, oldestId string, newestId string) ([]string, error) {
+	var ids []string
+	q := db.NewSelect().Model((*Status)(nil)).Column("id").
+		Where("account_id = ? AND host = ? AND deleted_at IS NULL AND source = ?", accountId, host, StatusSourceApi)
+	if oldestId != "" {
+		q = whereStatusId(q, "id", ">=", oldestId)
+	}
+	if newestId != "" {
+		q = whereStatusId(q, "id", "<=", newestId)
+	}
+	if err := q.Scan(ctx, &ids); err != nil {
+		return nil, fmt.Errorf("dSelectReconcileStatusIds: %v", err)
+	}
+	return ids, nil
+}
+
+// すでに削除済みにしたものはそのままにする。削除済みにした数を返す
+func dMarkStatusesDeleted(ctx context.Context, db bun.IDB, accountId string, host string, ids []string, now time.Time) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := db.NewUpdate().Model((*Status)(nil)).
+		Set("deleted_at = ?", now.UTC()).
+		Where("account_id = ? AND host = ? AND id IN (?) AND deleted_at IS NULL AND source = ?", accountId, host, bun.In(ids), StatusSourceApi).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("dMarkStatusesDeleted: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("dMarkStatusesDeleted: %v", err)
+	}
+	return n, nil
+}
+
+// まだ取り込んだことがなければゼロ値
+func dSelectCollectionState(ctx context.Context, db bun.IDB, accountId string, host string, collection string) (CollectionState, error) {
+	var state CollectionState
+	err := db.NewSelect().Model(&state).Where("account_id = ? AND host = ? AND collection = ?", accountId, host, collection).Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return state, fmt.Errorf("dSelectCollectionState: %v", err)
+	}
+	return state, nil
+}
+
+func dUpsertCollectionState(ctx context.Context, db bun.IDB, state CollectionState) error {
+	q := db.NewInsert().Model(&state)
+	if db.Dialect().Name() == dialect.MySQL {
+		q = q.On("DUPLICATE KEY UPDATE").Set("max_id = VALUES(max_id)").Set("all_fetched = VALUES(all_fetched)")
+	} else {
+		q = q.On("CONFLICT (account_id, host, collection) DO UPDATE").Set("max_id = EXCLUDED.max_id").Set("all_fetched = EXCLUDED.all_fetched")
+	}
+	if _, err := q.Exec(ctx); err != nil {
+		return fmt.Errorf("dUpsertCollectionState: %v", err)
+	}
+	return nil
+}
+
+// 同じ投稿を何度入れてもよい。最初に入れたときのadded_atが残る
+func dInsertCollectionItems(ctx context.Context, db bun.IDB, items []CollectionItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	for i := range items {
+		items[i].AddedAt = items[i].AddedAt.UTC()
+	}
+	if _, err := db.NewInsert().Model(&items).Ignore().Exec(ctx); err != nil {
+		return fmt.Errorf("dInsertCollectionItems: %v", err)
+	}
+	return nil
+}
+
+// idsのうちコレクションに入っているもの
+func dSelectCollectionStatusIds(ctx context.Context, db bun.IDB, accountId string, host string, collection string, ids []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	if len(ids) == 0 {
+		return existing, nil
+	}
+	var found []string
+	err := db.NewSelect().
+		Model((*CollectionItem)(nil)).
+		Column("status_id").
+		Where("account_id = ? AND host = ? AND collection = ?", accountId, host, collection).
+		Where("status_id IN (?)", bun.In(ids)).
+		Scan(ctx, &found)
+	if err != nil {
+		return nil, fmt.Errorf("dSelectCollectionStatusIds: %v", err)
+	}
+	for _, id := range found {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// rawは含まない。並び順は自分の投稿と同じく投稿のIDで、お気に入りにした順ではない
+func dSelectStatusesByCollection(ctx context.Context, db bun.IDB, accountId string, host string, collection string, page PageParams) (Page, error) {
+	var statuses []Status
+	q := db.NewSelect().
 		Model(&statuses).
-		Column("status.text", "status.created_at").
-		Join("INNER JOIN account").
-		JoinOn("status.account_id = account.id").
-		Where("account.user_name = ? AND account.host = ?", username, host).
-		Where("visibility in (?)", bun.In(visibilities)).
-		Order("status.id DESC").
+		ExcludeColumn("raw")
+	q = whereSearchScope(q, accountId, host, collection)
+	p, err := selectPage(ctx, q, &statuses, page, "status.id")
+	if err != nil {
+		return p, fmt.Errorf("dSelectStatusesByCollection: %v", err)
+	}
+	return p, nil
+}
+
+// 表示する投稿に、お気に入りやブックマークにした時刻を載せる
+func dAttachCollectionAddedAt(ctx context.Context, db bun.IDB, accountId string, host string, collection string, statuses []Status) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+	var ids []string
+	for _, status := range statuses {
+		ids = append(ids, status.Id)
+	}
+	var items []CollectionItem
+	err := db.NewSelect().
+		Model(&items).
+		Where("account_id = ? AND host = ? AND collection = ?", accountId, host, collection).
+		Where("status_id IN (?)", bun.In(ids)).
 		Scan(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("query failed: %v", err)
+		return fmt.Errorf("dAttachCollectionAddedAt: %v", err)
+	}
+	addedAt := map[string]time.Time{}
+	for _, item := range items {
+		addedAt[item.StatusId] = item.AddedAt
+	}
+	for i, status := range statuses {
+		statuses[i].AddedAt = addedAt[status.Id]
+	}
+	return nil
+}
+
+// どれかのコレクションに入っていればtrue
+func dCollectionsContainStatus(ctx context.Context, db bun.IDB, accountId string, host string, statusId string) (bool, error) {
+	exists, err := db.NewSelect().
+		Model((*CollectionItem)(nil)).
+		Where("account_id = ? AND host = ? AND status_id = ?", accountId, host, statusId).
+		Exists(ctx)
+	if err != nil {
+		return false, fmt.Errorf("dCollectionsContainStatus: %v", err)
 	}
-	return ConvertCreatedAtToTokyo(statuses), nil
+	return exists, nil
 }
@@ -1,6 +1,7 @@
 package activitypublog
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -14,3 +15,5 @@ func HandlerError(method string, path string, c echo.Context) func(error) error
 		return c.String(http.StatusInternalServerError, errString)
 	}
 }
+
+var ErrNotFound = errors.New("not found")
@@ -0,0 +1,426 @@
+package activitypublog
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// アーカイブをZIPにまとめるワーカー
+// 投稿は1ページずつDBから読んでZIPに書き出すので、アーカイブが大きくてもメモリはあまり使わない
+type Exporter struct {
+	server   *Server
+	dir      string
+	template *template.Template
+	kick     chan struct{}
+}
+
+func NewExporter(server *Server, dir string, templatePath string) (*Exporter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("NewExporter: %v", err)
+	}
+	// 画面と同じように、インスタンスから来たHTMLとURLはsanitizeとhttpUrlを通す
+	t, err := template.New(filepath.Base(templatePath)).Funcs(template.FuncMap{
+		"mediaPath": exportMediaPath,
+		"local": func(t time.Time) time.Time {
+			return t.In(server.config.Location)
+		},
+		"sanitize": sanitizeContent,
+		"httpUrl":  httpUrl,
+	}).ParseFiles(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("NewExporter: %v", err)
+	}
+	return &Exporter{server: server, dir: dir, template: t, kick: make(chan struct{}, 1)}, nil
+}
+
+// 同じアカウントのエクスポートが終わっていなければ、新しいジョブは作らずにそれを返す
+func (e *Exporter) Enqueue(ctx context.Context, accountId string, host string) (ExportJob, error) {
+	latest, err := dSelectLatestExportJob(ctx, e.server.db, accountId, host)
+	if err != nil {
+		return latest, err
+	}
+	if latest.State == ExportQueued || latest.State == ExportRunning {
+		return latest, nil
+	}
+	id, err := randomString(16)
+	if err != nil {
+		return ExportJob{}, err
+	}
+	job := ExportJob{Id: id, AccountId: accountId, Host: host, State: ExportQueued, CreatedAt: e.server.clock.Now()}
+	if err := dInsertExportJob(ctx, e.server.db, job); err != nil {
+		return ExportJob{}, err
+	}
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (e *Exporter) Path(job ExportJob) string {
+	return filepath.Join(e.dir, job.Id+".zip")
+}
+
+// 起動したときに残っているrunningのジョブは前回のプロセスが途中で止まったものなので、最初からやり直す
+// ctxがキャンセルされるまで戻らない
+func (e *Exporter) Run(ctx context.Context) {
+	for {
+		e.runUnfinished(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.kick:
+		}
+	}
+}
+
+func (e *Exporter) runUnfinished(ctx context.Context) {
+	jobs, err := dSelectUnfinishedExportJobs(ctx, e.server.db)
+	if err != nil {
+		fmt.Printf("export: failed to select jobs: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		job.State = ExportRunning
+		if err := dUpdateExportJob(ctx, e.server.db, job); err != nil {
+			fmt.Printf("export %s: %v\n", job.Id, err)
+			continue
+		}
+		count, size, err := e.build(ctx, job)
+		if ctx.Err() != nil {
+			// runningのまま残しておけば次に起動したときにやり直される
+			return
+		}
+		job.FinishedAt = e.server.clock.Now()
+		if err != nil {
+			fmt.Printf("export %s: %v\n", job.Id, err)
+			job.State = ExportFailed
+			job.Error = err.Error()
+		} else {
+			job.State = ExportDone
+			job.StatusCount = count
+			job.Size = size
+		}
+		if err := dUpdateExportJob(ctx, e.server.db, job); err != nil {
+			fmt.Printf("export %s: %v\n", job.Id, err)
+			continue
+		}
+		if job.State == ExportDone {
+			e.removeOlder(ctx, job)
+		}
+	}
+}
+
+// ダウンロードできるのは最新のものだけでよいので、古いファイルは消す
+func (e *Exporter) removeOlder(ctx context.Context, current ExportJob) {
+	jobs, err := dSelectExportJobs(ctx, e.server.db, current.AccountId, current.Host)
+	if err != nil {
+		fmt.Printf("export: %v\n", err)
+		return
+	}
+	for _, job := range jobs {
+		if job.Id == current.Id || !job.CreatedAt.Before(current.CreatedAt) {
+			continue
+		}
+		if err := os.Remove(e.Path(job)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("export %s: %v\n", job.Id, err)
+			continue
+		}
+		if err := dDeleteExportJob(ctx, e.server.db, job.Id); err != nil {
+			fmt.Printf("export %s: %v\n", job.Id, err)
+		}
+	}
+}
+
+// 書き終わるまでは.tmpに書き、できあがってから名前を変える
+func (e *Exporter) build(ctx context.Context, job ExportJob) (int, int64, error) {
+	path := e.Path(job)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	count, err := e.writeStatusesJson(ctx, zw, job)
+	if err != nil {
+		return 0, 0, fmt.Errorf("json: %v", err)
+	}
+	if err := e.writeStatusesCsv(ctx, zw, job); err != nil {
+		return 0, 0, fmt.Errorf("csv: %v", err)
+	}
+	media, err := e.writeHtml(ctx, zw, job)
+	if err != nil {
+		return 0, 0, fmt.Errorf("html: %v", err)
+	}
+	if err := e.writeMedia(ctx, zw, media); err != nil {
+		return 0, 0, fmt.Errorf("media: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, 0, err
+	}
+	return count, info.Size(), nil
+}
+
+// 新しい順に1ページずつ投稿を渡す
+func (e *Exporter) forEachExportPage(ctx context.Context, job ExportJob, fn func(statuses []Status, last bool) error) error {
+	page := PageParams{Limit: maxPageLimit}
+	for {
+		p, err := e.server.store.SelectStatusesWithRawByAccount(ctx, job.AccountId, job.Host, page)
+		if err != nil {
+			return err
+		}
+		statuses, err := e.server.attachMedia(ctx, p.Statuses)
+		if err != nil {
+			return err
+		}
+		statuses, err = e.server.attachTags(ctx, statuses)
+		if err != nil {
+			return err
+		}
+		if err := fn(statuses, p.NextMaxId == ""); err != nil {
+			return err
+		}
+		if p.NextMaxId == "" {
+			return nil
+		}
+		page.MaxId = p.NextMaxId
+	}
+}
+
+func (e *Exporter) createZipEntry(zw *zip.Writer, name string, method uint16) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: e.server.clock.Now()})
+}
+
+// ZIPの中のメディアのパス。拡張子を付けておくとブラウザで開いたときに再生できる
+func exportMediaPath(hash string, contentType string) string {
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		sort.Strings(exts)
+		return "media/" + hash + exts[0]
+	}
+	return "media/" + hash
+}
+
+type exportStatus struct {
+	ApiStatus
+	Tags []string        `json:"tags"`
+	Raw  json.RawMessage `json:"raw,omitempty"`
+}
+
+func newExportStatus(s Status) exportStatus {
+	status := exportStatus{ApiStatus: NewApiStatus(s), Tags: []string{}, Raw: s.Raw}
+	for i, m := range s.MediaAttachments {
+		status.MediaAttachments[i].Url = ""
+		status.MediaAttachments[i].PreviewUrl = ""
+		if m.BlobHash != "" {
+			status.MediaAttachments[i].Url = exportMediaPath(m.BlobHash, m.ContentType)
+		}
+		if m.PreviewBlobHash != "" {
+			status.MediaAttachments[i].PreviewUrl = exportMediaPath(m.PreviewBlobHash, m.PreviewContentType)
+		}
+	}
+	for _, tag := range s.Tags {
+		status.Tags = append(status.Tags, tag.Name)
+	}
+	return status
+}
+
+// 全体を1つの配列にするが、投稿は1件ずつエンコードして書き出す
+func (e *Exporter) writeStatusesJson(ctx context.Context, zw *zip.Writer, job ExportJob) (int, error) {
+	w, err := e.createZipEntry(zw, "statuses.json", zip.Deflate)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, err
+	}
+	err = e.forEachExportPage(ctx, job, func(statuses []Status, last bool) error {
+		for _, status := range statuses {
+			b, err := json.Marshal(newExportStatus(status))
+			if err != nil {
+				return err
+			}
+			sep := ",\n"
+			if count == 0 {
+				sep = "\n"
+			}
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, "\n]\n"); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Excelで開いても文字化けしないようにBOMを付ける
+func (e *Exporter) writeStatusesCsv(ctx context.Context, zw *zip.Writer, job ExportJob) error {
+	w, err := e.createZipEntry(zw, "statuses.csv", zip.Deflate)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	header := []string{"id", "created_at", "url", "visibility", "spoiler_text", "text", "tags", "media", "in_reply_to_id", "reblog_id", "replies_count", "reblogs_count", "favourites_count"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	err = e.forEachExportPage(ctx, job, func(statuses []Status, last bool) error {
+		for _, status := range statuses {
+			var tags, media []string
+			for _, tag := range status.Tags {
+				tags = append(tags, tag.Name)
+			}
+			for _, m := range status.MediaAttachments {
+				if m.BlobHash != "" {
+					media = append(media, exportMediaPath(m.BlobHash, m.ContentType))
+				} else {
+					media = append(media, m.RemoteUrl)
+				}
+			}
+			record := []string{
+				status.Id,
+				status.CreatedAt.Format(time.RFC3339),
+				status.Url,
+				status.Visibility,
+				status.SpoilerText,
+				status.Text,
+				strings.Join(tags, " "),
+				strings.Join(media, " "),
+				status.InReplyToId,
+				status.ReblogId,
+				strconv.Itoa(status.RepliesCount),
+				strconv.Itoa(status.ReblogsCount),
+				strconv.Itoa(status.FavouritesCount),
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type ExportPageProps struct {
+	Host     string
+	Page     int
+	PrevPage string
+	NextPage string
+	Statuses []Status
+}
+
+func exportPageName(n int) string {
+	if n == 1 {
+		return "index.html"
+	}
+	return fmt.Sprintf("page-%d.html", n)
+}
+
+// 1ページ分の投稿ごとにHTMLを作る。index.htmlが一番新しいページ
+// ZIPに入れるメディアを返す
+func (e *Exporter) writeHtml(ctx context.Context, zw *zip.Writer, job ExportJob) (map[string]string, error) {
+	media := map[string]string{}
+	n := 1
+	err := e.forEachExportPage(ctx, job, func(statuses []Status, last bool) error {
+		props := ExportPageProps{Host: job.Host, Page: n, Statuses: statuses}
+		if n > 1 {
+			props.PrevPage = exportPageName(n - 1)
+		}
+		if !last {
+			props.NextPage = exportPageName(n + 1)
+		}
+		w, err := e.createZipEntry(zw, exportPageName(n), zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if err := e.template.Execute(w, props); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			for _, m := range status.MediaAttachments {
+				if m.BlobHash != "" {
+					media[m.BlobHash] = m.ContentType
+				}
+				if m.PreviewBlobHash != "" {
+					media[m.PreviewBlobHash] = m.PreviewContentType
+				}
+			}
+		}
+		n++
+		return nil
+	})
+	return media, err
+}
+
+// 画像や動画はすでに圧縮されているので、圧縮せずに格納する
+func (e *Exporter) writeMedia(ctx context.Context, zw *zip.Writer, media map[string]string) error {
+	hashes := make([]string, 0, len(media))
+	for hash := range media {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		r, err := e.server.blobStore.Get(ctx, hash)
+		if err == ErrBlobNotFound {
+			fmt.Printf("export: media %s not found\n", hash)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w, err := e.createZipEntry(zw, exportMediaPath(hash, media[hash]), zip.Store)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package activitypublog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportPageEscapesValues(t *testing.T) {
+	e, err := NewExporter(newTestServer(t, nil), t.TempDir(), "public/export/archive.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = e.template.Execute(&b, ExportPageProps{Host: "example.com", Page: 1, Statuses: []Status{
+		{Url: "javascript:alert(1)", Text: "<img src=x onerror=alert(2)>"},
+		{Url: "https://example.com/@alice/1", Content: `<p>ok<script>alert(3)</script></p>`, MediaAttachments: []MediaAttachment{
+			{Type: "image", RemoteUrl: "javascript:alert(4)", Description: "<b>alt</b>"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := b.String()
+	for _, unsafe := range []string{"javascript:", "<script>", "<img src=x", "<b>alt"} {
+		if strings.Contains(html, unsafe) {
+			t.Errorf("exported page contains %q:\n%s", unsafe, html)
+		}
+	}
+	for _, want := range []string{`<a href="https://example.com/@alice/1">`, "<p>ok</p>", "&lt;b&gt;alt&lt;/b&gt;（未保存）"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("exported page does not contain %q:\n%s", want, html)
+		}
+	}
+}
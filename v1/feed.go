@@ -0,0 +1,429 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const feedTitleLength = 50
+
+// 公開アーカイブの新しい投稿をフィードとして配信する
+// 公開範囲の扱いは/users/:host/:usernameのページと同じ
+func (s *Server) registerFeedRoutes(e *echo.Echo) {
+	e.GET("/users/:host/:username/feed.atom", s.feedHandler("atom"))
+	e.GET("/users/:host/:username/feed.rss", s.feedHandler("rss"))
+	e.GET("/users/:host/:username/feed.json", s.feedHandler("json"))
+}
+
+type feedData struct {
+	Title    string
+	PageUrl  string
+	FeedUrl  string
+	Author   string
+	Updated  time.Time
+	Statuses []Status
+}
+
+func (s *Server) feedHandler(format string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", c.Path(), c)
+		ctx := c.Request().Context()
+		username := c.Param("username")
+		host := c.Param("host")
+		account, err := s.store.SelectAccountByUserName(ctx, username, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if !account.Public {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		page, err := s.store.SelectStatusesByAccountWithRestriction(ctx, username, host, "", PageParams{Limit: defaultPageLimit})
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err := s.attachMedia(ctx, page.Statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err = s.attachTags(ctx, statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+
+		etag, updated := feedValidators(format, statuses)
+		c.Response().Header().Set("ETag", etag)
+		if notModified(c.Request(), etag) {
+			return c.NoContent(http.StatusNotModified)
+		}
+
+		baseUrl := s.config.BaseUrl
+		data := feedData{
+			Title:    fmt.Sprintf("%s@%s のアーカイブ", username, host),
+			PageUrl:  fmt.Sprintf("%s/users/%s/%s", baseUrl, host, username),
+			FeedUrl:  baseUrl + c.Request().URL.Path,
+			Author:   fmt.Sprintf("%s@%s", username, host),
+			Updated:  updated,
+			Statuses: statuses,
+		}
+		if data.Updated.IsZero() {
+			data.Updated = s.clock.Now()
+		}
+		switch format {
+		case "atom":
+			return writeXmlFeed(c, "application/atom+xml; charset=utf-8", newAtomFeed(data, baseUrl))
+		case "rss":
+			return writeXmlFeed(c, "application/rss+xml; charset=utf-8", newRssFeed(data, baseUrl))
+		default:
+			c.Response().Header().Set(echo.HeaderContentType, "application/feed+json; charset=utf-8")
+			return c.JSON(http.StatusOK, newJsonFeed(data, baseUrl))
+		}
+	}
+}
+
+func (s *Server) attachTags(ctx context.Context, statuses []Status) ([]Status, error) {
+	if len(statuses) == 0 {
+		return statuses, nil
+	}
+	statusTags, err := dSelectStatusTagsByStatuses(ctx, s.db, statuses)
+	if err != nil {
+		return nil, err
+	}
+	byStatus := map[string][]Tag{}
+	for _, statusTag := range statusTags {
+		key := statusTag.Host + "/" + statusTag.StatusId
+		byStatus[key] = append(byStatus[key], Tag{Name: statusTag.TagName})
+	}
+	for i, status := range statuses {
+		statuses[i].Tags = byStatus[status.Host+"/"+status.Id]
+	}
+	return statuses, nil
+}
+
+// 含まれる投稿とその更新日時、メディアのアーカイブとブーストの写しが同じならETagも同じになる
+// メディアのアーカイブや写しは投稿を取り込んだあとで作られるので、更新日時だけでは変わったことがわからない
+// 公開範囲を変えたり削除済みの投稿を消したりしても投稿日時は進まないので、Last-Modifiedは送らない
+// 2つ目の戻り値はフィードの更新日時に使う、含まれる投稿の投稿日時と編集日時のうち最も新しいもの
+func feedValidators(format string, statuses []Status) (string, time.Time) {
+	h := sha256.New()
+	h.Write([]byte(format))
+	var updatedAt time.Time
+	for _, status := range statuses {
+		updated := statusUpdatedAt(status)
+		fmt.Fprintf(h, "\n%s/%s/%d", status.Host, status.Id, updated.Unix())
+		for _, m := range status.MediaAttachments {
+			fmt.Fprintf(h, " %q %q %q %q", m.Id, feedMediaUrl("", m), feedMediaType(m), m.Description)
+		}
+		if r := status.Reblog; r != nil {
+			fmt.Fprintf(h, " reblog %q %q %q %q %q", r.Url, r.AccountAcct, r.AccountUrl, r.Text, r.Content)
+		}
+		if updated.After(updatedAt) {
+			updatedAt = updated
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`, updatedAt
+}
+
+func statusUpdatedAt(status Status) time.Time {
+	if status.EditedAt.After(status.CreatedAt) {
+		return status.EditedAt
+	}
+	return status.CreatedAt
+}
+
+// If-None-Matchだけで判断する。Last-Modifiedは送っていないのでIf-Modified-Sinceは見ない
+func notModified(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeXmlFeed(c echo.Context, contentType string, feed interface{}) error {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return HandlerError("GET", c.Path(), c)(err)
+	}
+	return c.Blob(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
+
+// 本文の先頭を見出しにする。注意書きがあればそちらを使う
+func feedEntryTitle(status Status) string {
+	if r := status.Reblog; r != nil {
+		return "@" + r.AccountAcct + " の投稿をブースト: " + feedEntryTitle(Status{Text: r.Text, SpoilerText: r.SpoilerText})
+	}
+	if status.SpoilerText != "" {
+		return status.SpoilerText
+	}
+	text := strings.Join(strings.Fields(status.Text), " ")
+	if utf8.RuneCountInString(text) <= feedTitleLength {
+		return text
+	}
+	return string([]rune(text)[:feedTitleLength]) + "…"
+}
+
+// 本文のHTMLを保存していない古い投稿はテキストから作る。HTMLは画面と同じように許可したタグだけを残す
+// ブーストなら元の投稿へのリンクを付けて元の投稿の本文にする
+func feedContentHtml(status Status) string {
+	if r := status.Reblog; r != nil {
+		// 元の投稿は他人が書いたものなので、リンクはhttpとhttpsに限る
+		account := "@" + html.EscapeString(r.AccountAcct)
+		if u := httpUrl(r.AccountUrl); u != "" {
+			account = `<a href="` + html.EscapeString(u) + `">` + account + `</a>`
+		}
+		boost := "ブースト"
+		if u := httpUrl(r.Url); u != "" {
+			boost = `<a href="` + html.EscapeString(u) + `">` + boost + `</a>`
+		}
+		return "<p>" + account + " の投稿を" + boost + "</p>" + feedContentHtml(Status{Text: r.Text, Content: r.Content})
+	}
+	if status.Content != "" {
+		return string(sanitizeContent(status.Content))
+	}
+	return strings.ReplaceAll(html.EscapeString(status.Text), "\n", "<br>")
+}
+
+// アーカイブ済みならこのサーバーのURLを、まだなら元のURLを使う
+func feedMediaUrl(baseUrl string, m MediaAttachment) string {
+	if m.BlobHash != "" {
+		return baseUrl + "/media/" + m.BlobHash
+	}
+	return m.RemoteUrl
+}
+
+func feedMediaType(m MediaAttachment) string {
+	if m.ContentType != "" {
+		return m.ContentType
+	}
+	switch m.Type {
+	case "image":
+		return "image/jpeg"
+	case "gifv", "video":
+		return "video/mp4"
+	case "audio":
+		return "audio/mpeg"
+	}
+	return "application/octet-stream"
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href  string `xml:"href,attr"`
+	Rel   string `xml:"rel,attr,omitempty"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+func newAtomFeed(data feedData, baseUrl string) atomFeed {
+	feed := atomFeed{
+		Id:      data.PageUrl,
+		Title:   data.Title,
+		Updated: data.Updated.Format(time.RFC3339),
+		Author:  atomAuthor{Name: data.Author},
+		Links: []atomLink{
+			{Href: data.PageUrl, Rel: "alternate", Type: "text/html"},
+			{Href: data.FeedUrl, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	for _, status := range data.Statuses {
+		entry := atomEntry{
+			Id:        status.Url,
+			Title:     feedEntryTitle(status),
+			Published: status.CreatedAt.Format(time.RFC3339),
+			Updated:   statusUpdatedAt(status).Format(time.RFC3339),
+			Links:     []atomLink{{Href: status.Url, Rel: "alternate", Type: "text/html"}},
+			Content:   atomContent{Type: "html", Body: feedContentHtml(status)},
+		}
+		for _, tag := range status.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag.Name})
+		}
+		for _, m := range status.MediaAttachments {
+			entry.Links = append(entry.Links, atomLink{Href: feedMediaUrl(baseUrl, m), Rel: "enclosure", Type: feedMediaType(m), Title: m.Description})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          rssSelf   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssSelf struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGuid struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// RSS 2.0のenclosureはlengthが必須だが、ファイルの大きさは保存していないので0にする
+type rssEnclosure struct {
+	Url    string `xml:"url,attr"`
+	Length string `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string         `xml:"title"`
+	Link        string         `xml:"link"`
+	Guid        rssGuid        `xml:"guid"`
+	PubDate     string         `xml:"pubDate"`
+	Categories  []string       `xml:"category"`
+	Description string         `xml:"description"`
+	Enclosures  []rssEnclosure `xml:"enclosure"`
+}
+
+func newRssFeed(data feedData, baseUrl string) rssFeed {
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         data.Title,
+			Link:          data.PageUrl,
+			Description:   data.Title,
+			LastBuildDate: data.Updated.Format(time.RFC1123Z),
+			Self:          rssSelf{Href: data.FeedUrl, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	for _, status := range data.Statuses {
+		item := rssItem{
+			Title:       feedEntryTitle(status),
+			Link:        status.Url,
+			Guid:        rssGuid{IsPermaLink: "true", Value: status.Url},
+			PubDate:     status.CreatedAt.Format(time.RFC1123Z),
+			Description: feedContentHtml(status),
+		}
+		for _, tag := range status.Tags {
+			item.Categories = append(item.Categories, tag.Name)
+		}
+		for _, m := range status.MediaAttachments {
+			item.Enclosures = append(item.Enclosures, rssEnclosure{Url: feedMediaUrl(baseUrl, m), Length: "0", Type: feedMediaType(m)})
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return feed
+}
+
+// https://www.jsonfeed.org/version/1.1/
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageUrl string           `json:"home_page_url"`
+	FeedUrl     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	Url      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Title    string `json:"title,omitempty"`
+}
+
+type jsonFeedItem struct {
+	Id            string               `json:"id"`
+	Url           string               `json:"url"`
+	Title         string               `json:"title,omitempty"`
+	ContentHtml   string               `json:"content_html"`
+	ContentText   string               `json:"content_text,omitempty"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified,omitempty"`
+	Tags          []string             `json:"tags,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+func newJsonFeed(data feedData, baseUrl string) jsonFeed {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       data.Title,
+		HomePageUrl: data.PageUrl,
+		FeedUrl:     data.FeedUrl,
+		Authors:     []jsonFeedAuthor{{Name: data.Author}},
+		Items:       []jsonFeedItem{},
+	}
+	for _, status := range data.Statuses {
+		item := jsonFeedItem{
+			Id:            status.Url,
+			Url:           status.Url,
+			Title:         status.SpoilerText,
+			ContentHtml:   feedContentHtml(status),
+			ContentText:   status.Text,
+			DatePublished: status.CreatedAt.Format(time.RFC3339),
+		}
+		if !status.EditedAt.IsZero() {
+			item.DateModified = status.EditedAt.Format(time.RFC3339)
+		}
+		for _, tag := range status.Tags {
+			item.Tags = append(item.Tags, tag.Name)
+		}
+		for _, m := range status.MediaAttachments {
+			item.Attachments = append(item.Attachments, jsonFeedAttachment{Url: feedMediaUrl(baseUrl, m), MimeType: feedMediaType(m), Title: m.Description})
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed
+}
@@ -0,0 +1,94 @@
+package activitypublog
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFeedValidators(t *testing.T) {
+	createdAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	base := func() []Status {
+		return []Status{
+			{Id: "1", Host: "example.com", CreatedAt: createdAt},
+			{Id: "2", Host: "example.com", CreatedAt: createdAt.Add(time.Hour), MediaAttachments: []MediaAttachment{{Id: "m", Type: "image", RemoteUrl: "https://example.com/m.png"}}},
+		}
+	}
+	etag, updated := feedValidators("atom", base())
+	if !updated.Equal(createdAt.Add(time.Hour)) {
+		t.Errorf("updated = %v, want the newest created_at", updated)
+	}
+	if again, _ := feedValidators("atom", base()); again != etag {
+		t.Errorf("etag = %s, then %s for the same statuses", etag, again)
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		change func(statuses []Status)
+	}{
+		{"format", "rss", func(statuses []Status) {}},
+		{"edited", "atom", func(statuses []Status) { statuses[0].EditedAt = createdAt.Add(2 * time.Hour) }},
+		{"added", "atom", func(statuses []Status) { statuses[0].Id = "3" }},
+		{"media archived", "atom", func(statuses []Status) { statuses[1].MediaAttachments[0].BlobHash = "abc" }},
+		{"media description", "atom", func(statuses []Status) { statuses[1].MediaAttachments[0].Description = "alt" }},
+		{"reblog snapshot", "atom", func(statuses []Status) { statuses[0].Reblog = &Reblog{Url: "https://example.com/@bob/3"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := base()
+			tt.change(statuses)
+			if got, _ := feedValidators(tt.format, statuses); got == etag {
+				t.Errorf("etag did not change")
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", nil, false},
+		{"etag matches", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak etag matches", map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"one of etags", map[string]string{"If-None-Match": `"x", "abc"`}, true},
+		{"any", map[string]string{"If-None-Match": "*"}, true},
+		{"etag differs", map[string]string{"If-None-Match": `"x"`}, false},
+		{"etag wins over date", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": "Fri, 01 Jan 2027 00:00:00 GMT"}, false},
+		{"date is ignored", map[string]string{"If-Modified-Since": "Fri, 01 Jan 2027 00:00:00 GMT"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users/example.com/alice/feed.atom", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			if got := notModified(r, `"abc"`); got != tt.want {
+				t.Errorf("notModified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedContentHtml(t *testing.T) {
+	tests := []struct {
+		name   string
+		status Status
+		want   string
+	}{
+		{"content", Status{Content: `<p>hi<script>alert(1)</script></p>`, Text: "hi"}, "<p>hi</p>"},
+		{"text only", Status{Text: "a < b\nc"}, "a &lt; b<br>c"},
+		{"reblog", Status{Reblog: &Reblog{AccountAcct: "bob@other.example", AccountUrl: "https://other.example/@bob", Url: "https://other.example/@bob/1", Content: "<p>yo</p>"}},
+			`<p><a href="https://other.example/@bob">@bob@other.example</a> の投稿を<a href="https://other.example/@bob/1">ブースト</a></p><p>yo</p>`},
+		{"reblog with script urls", Status{Reblog: &Reblog{AccountAcct: "bob", AccountUrl: "javascript:alert(1)", Url: "data:text/html,x", Text: "yo"}},
+			"<p>@bob の投稿をブースト</p>yo"},
+	}
+	for _, tt := range tests {
+		if got := feedContentHtml(tt.status); got != tt.want {
+			t.Errorf("%s: feedContentHtml = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
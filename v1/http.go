@@ -1,130 +1,193 @@
 package activitypublog
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
-	"time"
+
+	"github.com/chao7150/activitypublog/mastodon"
 )
 
-func hPostApp(host string, baseUrl string) (App, error) {
-	var app App
-	path := "https://" + host + "/api/v1/apps"
-	resp, err := http.PostForm(path, url.Values{"client_name": {"chao-activitypublog"}, "redirect_uris": {baseUrl + "/authorize"}})
-	if err != nil {
-		return app, fmt.Errorf("failed to create app for the host: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return app, fmt.Errorf("failed to read response from server: %v", err)
+// インスタンスのAPIを呼ぶクライアント
+// レート制限の残りはクライアントが覚えているので、続けて呼ぶときは同じものを使う
+// レート制限はトークンごとなので、同期、遡り、ストリーミングが同じクライアントを使って残りを共有する
+func (s *Server) mastodonClient(host string, token string) *mastodon.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := host + "\n" + token
+	if client, ok := s.mastodonClients[key]; ok {
+		return client
 	}
+	client := mastodon.NewClient(host, token, s.httpClient)
+	client.MinInterval = s.config.RequestInterval
+	s.mastodonClients[key] = client
+	return client
+}
 
-	if err := json.Unmarshal(body, &app); err != nil {
-		return app, fmt.Errorf("failed to parse response from server: %v", err)
-	}
-	app.Host = host
-	return app, nil
+// ログアウトして使わなくなったトークンのクライアントを捨てる
+func (s *Server) forgetMastodonClient(host string, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mastodonClients, host+"\n"+token)
 }
 
-func hGetVerifyCredentials(host string, token string) (Account, error) {
-	var account Account
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+host+"/api/v1/accounts/verify_credentials", nil)
+func hPostApp(ctx context.Context, client *mastodon.Client, baseUrl string, clientName string) (App, error) {
+	app, err := client.CreateApp(ctx, clientName, baseUrl+"/authorize")
 	if err != nil {
-		return account, fmt.Errorf("failed to create request: %v", err)
+		return App{}, fmt.Errorf("failed to create app for the host: %v", err)
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
+	return App{Host: client.Host, ClientId: app.ClientId, ClientSecret: app.ClientSecret}, nil
+}
+
+func hApplication(app App) mastodon.Application {
+	return mastodon.Application{ClientId: app.ClientId, ClientSecret: app.ClientSecret}
+}
+
+// 認可コードをアクセストークンに交換する
+func hPostOauthToken(ctx context.Context, client *mastodon.Client, app App, code string, redirectUri string) (mastodon.Token, error) {
+	token, err := client.ObtainToken(ctx, hApplication(app), code, redirectUri)
 	if err != nil {
-		return account, fmt.Errorf("failed to GET verify_credentials: %v", err)
+		return token, fmt.Errorf("failed to obtain token: %v", err)
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return token, nil
+}
+
+func hGetVerifyCredentials(ctx context.Context, client *mastodon.Client) (Account, error) {
+	a, err := client.VerifyCredentials(ctx)
 	if err != nil {
-		return account, fmt.Errorf("failed to read response body: %v", err)
-	}
-	if err := json.Unmarshal(body, &account); err != nil {
-		fmt.Printf("failed to parse account data: raw data: %v", body)
-		return account, fmt.Errorf("failed to parse account data: %v", err)
+		return Account{}, fmt.Errorf("failed to GET verify_credentials: %w", err)
 	}
-	return account, nil
+	return Account{Id: a.Id, Host: client.Host, Acct: a.Acct, Avatar: a.Avatar, DisplayName: a.DisplayName, Url: a.Url, UserName: a.Username}, nil
 }
 
-type hGetAccountStatusesResponse []struct {
-	Id         string
-	Account    Account
-	Text       string
-	Url        string
-	CreatedAt  string `json:"created_at"`
-	Tags       []Tag
-	Visibility string
+// APIが返したstatusをStatusに変換する。生のJSONもRawとして残す
+func hConvertStatus(v mastodon.Status, host string, accountId string) Status {
+	tags := make([]Tag, 0, len(v.Tags))
+	for _, tag := range v.Tags {
+		tags = append(tags, Tag{Name: tag.Name, Url: tag.Url})
+	}
+	s := Status{
+		Id:              v.Id,
+		Account:         Account{Id: v.Account.Id, Host: host, Acct: v.Account.Acct, Avatar: v.Account.Avatar, DisplayName: v.Account.DisplayName, Url: v.Account.Url, UserName: v.Account.Username},
+		Text:            v.Text,
+		Content:         v.Content,
+		SpoilerText:     v.SpoilerText,
+		Sensitive:       v.Sensitive,
+		Url:             v.Url,
+		CreatedAt:       v.CreatedAt,
+		RepliesCount:    v.RepliesCount,
+		ReblogsCount:    v.ReblogsCount,
+		FavouritesCount: v.FavouritesCount,
+		Tags:            tags,
+		Host:            host,
+		AccountId:       accountId,
+		Visibility:      v.Visibility,
+		Raw:             v.Raw,
+	}
+	// textは削除して書き直すときくらいしか返ってこないので、検索用にcontentから作る
+	if s.Text == "" {
+		s.Text = htmlToText(v.Content)
+	}
+	if v.Language != nil {
+		s.Language = *v.Language
+	}
+	if v.InReplyToId != nil {
+		s.InReplyToId = *v.InReplyToId
+	}
+	if v.EditedAt != nil {
+		s.EditedAt = *v.EditedAt
+	}
+	if v.Application != nil {
+		s.ApplicationName = v.Application.Name
+		s.ApplicationWebsite = v.Application.Website
+	}
+	if len(v.Poll) != 0 && string(v.Poll) != "null" {
+		s.Poll = v.Poll
+	}
+	s.MediaAttachments = hConvertMediaAttachments(v.MediaAttachments, host, v.Id)
+	if v.Reblog != nil {
+		s.ReblogId = v.Reblog.Id
+		s.Reblog = hConvertReblog(*v.Reblog, host, v.Id)
+		// ブーストそのものには添付がないので、元の投稿の添付をブーストした投稿のものとして保存する
+		s.MediaAttachments = hConvertMediaAttachments(v.Reblog.MediaAttachments, host, v.Id)
+	}
+	return s
 }
 
-func hGetAccountStatuses(host string, token string, id string, params string) ([]Status, error) {
-	var statuses []Status
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+host+"/api/v1/accounts/"+id+"/statuses?"+params, nil)
-	if err != nil {
-		return statuses, fmt.Errorf("failed to create request: %v", err)
-	}
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
-	if err != nil {
-		return statuses, fmt.Errorf("failed to GET accounts/:id/statuses: %v", err)
+// ブーストされた元の投稿から、ブーストした投稿statusIdに付ける写しを作る
+func hConvertReblog(v mastodon.Status, host string, statusId string) *Reblog {
+	r := &Reblog{
+		StatusId:           statusId,
+		Host:               host,
+		Url:                v.Url,
+		AccountAcct:        v.Account.Acct,
+		AccountDisplayName: v.Account.DisplayName,
+		AccountUrl:         v.Account.Url,
+		AccountAvatar:      v.Account.Avatar,
+		Text:               v.Text,
+		Content:            v.Content,
+		SpoilerText:        v.SpoilerText,
+		Sensitive:          v.Sensitive,
+		CreatedAt:          v.CreatedAt,
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return statuses, fmt.Errorf("failed to read response body: %v", err)
+	if r.Text == "" {
+		r.Text = htmlToText(v.Content)
 	}
-	var res hGetAccountStatusesResponse
-	if err := json.Unmarshal(body, &res); err != nil {
-		fmt.Printf("failed to parse account data: raw data: %v", body)
-		return statuses, fmt.Errorf("failed to parse account data: %v", err)
+	return r
+}
+
+func hConvertMediaAttachments(ms []mastodon.MediaAttachment, host string, statusId string) []MediaAttachment {
+	var attachments []MediaAttachment
+	for _, m := range ms {
+		// インスタンスがメディアをキャッシュしていなければurlが空になる
+		remoteUrl := m.Url
+		if remoteUrl == "" {
+			remoteUrl = m.RemoteUrl
+		}
+		attachments = append(attachments, MediaAttachment{
+			Id:               m.Id,
+			Host:             host,
+			StatusId:         statusId,
+			Type:             m.Type,
+			RemoteUrl:        remoteUrl,
+			PreviewRemoteUrl: m.PreviewUrl,
+			Description:      m.Description,
+			Blurhash:         m.Blurhash,
+		})
 	}
+	return attachments
+}
 
-	location, _ := time.LoadLocation("Asia/Tokyo")
-	for _, v := range res {
-		ca, err := time.Parse(time.RFC3339, v.CreatedAt)
-		if err != nil {
-			continue
+// Linkヘッダーをたどって1ページずつ変換してfnに渡す。fnがエラーを返したらそこで止まる
+// relがmastodon.RelNextなら古い方へ、mastodon.RelPrevなら新しい方へ進む
+func hForEachAccountStatusPage(ctx context.Context, client *mastodon.Client, id string, params url.Values, rel string, fn func(statuses []Status) error) error {
+	pager := client.AccountStatusPages(id, params, rel)
+	for pager.Next(ctx) {
+		statuses := make([]Status, 0, len(pager.Page()))
+		for _, v := range pager.Page() {
+			statuses = append(statuses, hConvertStatus(v, client.Host, id))
 		}
-		s := Status{
-			Id:         v.Id,
-			Account:    v.Account,
-			Text:       v.Text,
-			Url:        v.Url,
-			CreatedAt:  ca.In(location),
-			Tags:       v.Tags,
-			Host:       host,
-			AccountId:  id,
-			Visibility: v.Visibility,
+		if err := fn(statuses); err != nil {
+			return err
 		}
-		statuses = append(statuses, s)
 	}
-	return statuses, nil
+	if err := pager.Err(); err != nil {
+		return fmt.Errorf("failed to GET accounts/:id/statuses: %w", err)
+	}
+	return nil
 }
 
-func hGetAccountStatusesOlderThan(host string, token string, id string, maxId string) ([]Status, error) {
-	return hGetAccountStatuses(host, token, id, "max_id="+maxId)
+// お気に入りかブックマークのページをたどるpager
+func hCollectionPages(client *mastodon.Client, collection string, params url.Values, rel string) *mastodon.StatusPager {
+	if collection == CollectionBookmarks {
+		return client.BookmarkPages(params, rel)
+	}
+	return client.FavouritePages(params, rel)
 }
 
-func hGetAccountStatusesAll(host string, token string, id string, minId string, maxId string) ([]Status, error) {
-	var statuses []Status
-	for {
-		s, err := hGetAccountStatuses(host, token, id, "max_id="+maxId+"&min_id="+minId)
-		if err != nil {
-			return statuses, err
-		}
-		if len(s) == 0 {
-			break
-		}
-		statuses = append(statuses, s...)
-		maxId = s[len(s)-1].Id
-		time.Sleep(time.Second * 2)
+func hPostOauthRevoke(ctx context.Context, client *mastodon.Client, app App, token string) error {
+	if err := client.RevokeToken(ctx, hApplication(app), token); err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
 	}
-	return statuses, nil
+	return nil
 }
@@ -0,0 +1,366 @@
+package activitypublog
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const importBatchSize = 200
+
+const activityStreamsPublic = "https://www.w3.org/ns/activitystreams#Public"
+
+type ImportResult struct {
+	// 新しく取り込んだ投稿
+	Imported int
+	// すでに保存されていた投稿
+	Skipped int
+	// ブーストや他人の投稿など、取り込まなかったアクティビティ
+	Ignored int
+	// アーカイブに含まれていたメディアのうち保存したもの
+	Media int
+}
+
+// 文字列1つでも配列でもよいプロパティ
+type apStrings []string
+
+func (s *apStrings) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = apStrings{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+type apOutbox struct {
+	OrderedItems []apActivity `json:"orderedItems"`
+}
+
+type apActivity struct {
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apNote struct {
+	Id         string            `json:"id"`
+	Type       string            `json:"type"`
+	Url        string            `json:"url"`
+	Published  time.Time         `json:"published"`
+	Updated    time.Time         `json:"updated"`
+	Summary    string            `json:"summary"`
+	Content    string            `json:"content"`
+	ContentMap map[string]string `json:"contentMap"`
+	Sensitive  bool              `json:"sensitive"`
+	InReplyTo  string            `json:"inReplyTo"`
+	To         apStrings         `json:"to"`
+	Cc         apStrings         `json:"cc"`
+	Attachment []apAttachment    `json:"attachment"`
+	Tag        []apTag           `json:"tag"`
+}
+
+type apAttachment struct {
+	MediaType string `json:"mediaType"`
+	Url       string `json:"url"`
+	Name      string `json:"name"`
+	Blurhash  string `json:"blurhash"`
+}
+
+type apTag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// アカウントのアーカイブ(outbox.jsonとmedia_attachments/)を取り込む
+// mediaがnilならメディアは取り込まず、あとで同期するときに元のURLから保存する
+// アーカイブには過去の投稿がすべて入っているので、取り込めたらAllFetchedにする
+func (s *Server) ImportOutbox(ctx context.Context, outbox io.Reader, media fs.FS, account Account) (ImportResult, error) {
+	var result ImportResult
+	var o apOutbox
+	if err := json.NewDecoder(outbox).Decode(&o); err != nil {
+		return result, fmt.Errorf("ImportOutbox: invalid outbox.json: %v", err)
+	}
+	var batch []Status
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var ids []string
+		for _, status := range batch {
+			ids = append(ids, status.Id)
+		}
+		existing, err := s.store.SelectExistingStatusIds(ctx, ids, account.Host)
+		if err != nil {
+			return err
+		}
+		var statuses []Status
+		for _, status := range batch {
+			if existing[status.Id] {
+				result.Skipped++
+				continue
+			}
+			n, err := s.importMedia(ctx, media, status.MediaAttachments)
+			if err != nil {
+				return err
+			}
+			result.Media += n
+			statuses = append(statuses, status)
+		}
+		r, err := s.ingestStatuses(ctx, statuses, account.Id, account.Host)
+		if err != nil {
+			return err
+		}
+		result.Imported += r.Inserted
+		// 調べたあとに同期で入った投稿
+		result.Skipped += r.Updated + r.Unchanged
+		batch = nil
+		return nil
+	}
+	for _, activity := range o.OrderedItems {
+		if activity.Type != "Create" || !isOwnActor(activity.Actor, account) {
+			result.Ignored++
+			continue
+		}
+		var note apNote
+		if err := json.Unmarshal(activity.Object, &note); err != nil || note.Id == "" {
+			result.Ignored++
+			continue
+		}
+		batch = append(batch, convertNote(note, activity.Actor, account))
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return result, fmt.Errorf("ImportOutbox: %v", err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, fmt.Errorf("ImportOutbox: %v", err)
+	}
+	if result.Imported+result.Skipped > 0 {
+		if err := s.store.UpdateAccountAllFetched(ctx, account.Id, account.Host); err != nil {
+			return result, fmt.Errorf("ImportOutbox: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// MastodonもGoToSocialもactorは https://host/users/username の形
+func isOwnActor(actor string, account Account) bool {
+	u, err := url.Parse(actor)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, account.Host) && strings.EqualFold(path.Base(u.Path), account.UserName)
+}
+
+func convertNote(note apNote, actor string, account Account) Status {
+	status := Status{
+		Id:          path.Base(note.Id),
+		Host:        account.Host,
+		AccountId:   account.Id,
+		Content:     note.Content,
+		Text:        htmlToText(note.Content),
+		SpoilerText: note.Summary,
+		Sensitive:   note.Sensitive,
+		Url:         note.Url,
+		CreatedAt:   note.Published,
+		EditedAt:    note.Updated,
+		Visibility:  noteVisibility(note, actor),
+		Source:      StatusSourceImport,
+	}
+	if status.Url == "" {
+		status.Url = note.Id
+	}
+	for language := range note.ContentMap {
+		status.Language = language
+		break
+	}
+	// 返信先のidはインスタンスの中でしか意味がないので、同じインスタンスの投稿への返信だけ埋める
+	if u, err := url.Parse(note.InReplyTo); err == nil && note.InReplyTo != "" && strings.EqualFold(u.Host, account.Host) {
+		status.InReplyToId = path.Base(u.Path)
+	}
+	for _, tag := range note.Tag {
+		if tag.Type == "Hashtag" {
+			status.Tags = append(status.Tags, Tag{Name: tag.Name})
+		}
+	}
+	for _, attachment := range note.Attachment {
+		remoteUrl, ok := importedMediaUrl(attachment.Url, account)
+		if !ok {
+			continue
+		}
+		status.MediaAttachments = append(status.MediaAttachments, MediaAttachment{
+			Id:          importedMediaId(attachment.Url),
+			Host:        account.Host,
+			StatusId:    status.Id,
+			Type:        mediaTypeOf(attachment.MediaType),
+			RemoteUrl:   remoteUrl,
+			Description: attachment.Name,
+			Blurhash:    attachment.Blurhash,
+			ContentType: attachment.MediaType,
+		})
+	}
+	return status
+}
+
+// アーカイブでは /media_attachments/... のようにパスだけが書かれている
+// ファイルがアーカイブになければあとでこのURLから取りに行くので、アカウントのインスタンスのhttpsのURLしか受け付けない
+func importedMediaUrl(raw string, account Account) (string, bool) {
+	if strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") {
+		raw = "https://" + account.Host + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || !strings.EqualFold(u.Host, account.Host) {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func noteVisibility(note apNote, actor string) string {
+	for _, to := range note.To {
+		if to == activityStreamsPublic || to == "as:Public" || to == "Public" {
+			return "public"
+		}
+	}
+	for _, cc := range note.Cc {
+		if cc == activityStreamsPublic || cc == "as:Public" || cc == "Public" {
+			return "unlisted"
+		}
+	}
+	for _, to := range note.To {
+		if to == actor+"/followers" {
+			return "private"
+		}
+	}
+	return "direct"
+}
+
+func mediaTypeOf(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	}
+	return "unknown"
+}
+
+// Mastodonのメディアのパスは /media_attachments/files/109/876/543/.../original/x.png のようにidを3桁ずつ区切ったもの
+// idが読み取れなければURLのハッシュを使う
+func importedMediaId(mediaUrl string) string {
+	var id strings.Builder
+	for _, segment := range strings.Split(mediaUrl, "/") {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			id.WriteString(segment)
+		}
+	}
+	if id.Len() > 0 {
+		return id.String()
+	}
+	sum := sha256.Sum256([]byte(mediaUrl))
+	return hex.EncodeToString(sum[:16])
+}
+
+// アーカイブにファイルがあればそれを保存する。保存した数を返す
+func (s *Server) importMedia(ctx context.Context, media fs.FS, attachments []MediaAttachment) (int, error) {
+	if media == nil {
+		return 0, nil
+	}
+	stored := 0
+	for i, attachment := range attachments {
+		u, err := url.Parse(attachment.RemoteUrl)
+		if err != nil {
+			continue
+		}
+		f, err := media.Open(strings.TrimPrefix(u.Path, "/"))
+		if err != nil {
+			continue
+		}
+		hash, err := storeBlob(ctx, s.blobStore, f, attachment.ContentType, s.config.Media.MaxBytes)
+		f.Close()
+		if err != nil {
+			return stored, err
+		}
+		attachments[i].BlobHash = hash
+		attachments[i].PreviewBlobHash = hash
+		attachments[i].PreviewContentType = attachment.ContentType
+		stored++
+	}
+	return stored, nil
+}
+
+// zipならそのまま、outbox.jsonだけならメディアなしで取り込む
+func (s *Server) ImportArchiveFile(ctx context.Context, r io.ReaderAt, size int64, name string, account Account) (ImportResult, error) {
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		return s.ImportOutbox(ctx, io.NewSectionReader(r, 0, size), nil, account)
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("ImportArchiveFile: %v", err)
+	}
+	return s.importArchiveFS(ctx, zr, account)
+}
+
+func (s *Server) importArchiveFS(ctx context.Context, fsys fs.FS, account Account) (ImportResult, error) {
+	outbox, err := fsys.Open("outbox.json")
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("outbox.json not found in archive: %v", err)
+	}
+	defer outbox.Close()
+	return s.ImportOutbox(ctx, outbox, fsys, account)
+}
+
+// CLIから取り込む。pathはzip、展開したディレクトリ、outbox.jsonのどれでもよい
+func RunImport(config Config, archivePath string, username string, host string) {
+	ctx := context.Background()
+	s, err := setup(ctx, config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	account, err := s.store.SelectAccountByUserName(ctx, username, host)
+	if err != nil {
+		fmt.Printf("account %s@%s not found. log in once before importing: %v\n", username, host, err)
+		os.Exit(1)
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var result ImportResult
+	if info.IsDir() {
+		result, err = s.importArchiveFS(ctx, os.DirFS(archivePath), account)
+	} else {
+		f, openErr := os.Open(archivePath)
+		if openErr != nil {
+			fmt.Println(openErr)
+			os.Exit(1)
+		}
+		defer f.Close()
+		result, err = s.ImportArchiveFile(ctx, f, info.Size(), info.Name(), account)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("imported %d statuses (%d already stored, %d activities ignored, %d media files)\n", result.Imported, result.Skipped, result.Ignored, result.Media)
+}
@@ -0,0 +1,115 @@
+package activitypublog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertNote(t *testing.T) {
+	account := Account{Id: "1", UserName: "alice", Host: "example.com"}
+	actor := "https://example.com/users/alice"
+	published := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	note := apNote{
+		Id:         "https://example.com/users/alice/statuses/100",
+		Url:        "https://example.com/@alice/100",
+		Published:  published,
+		Summary:    "cw",
+		Content:    "<p>hello<br>world</p>",
+		ContentMap: map[string]string{"ja": "<p>hello<br>world</p>"},
+		Sensitive:  true,
+		InReplyTo:  "https://example.com/users/bob/statuses/99",
+		To:         apStrings{activityStreamsPublic},
+		Tag:        []apTag{{Type: "Hashtag", Name: "#go"}, {Type: "Mention", Name: "@bob"}},
+	}
+	status := convertNote(note, actor, account)
+	want := Status{
+		Id:          "100",
+		Host:        "example.com",
+		AccountId:   "1",
+		Content:     "<p>hello<br>world</p>",
+		Text:        htmlToText("<p>hello<br>world</p>"),
+		SpoilerText: "cw",
+		Sensitive:   true,
+		Language:    "ja",
+		InReplyToId: "99",
+		Url:         "https://example.com/@alice/100",
+		CreatedAt:   published,
+		Visibility:  "public",
+		Source:      StatusSourceImport,
+		Tags:        []Tag{{Name: "#go"}},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("convertNote = %+v, want %+v", status, want)
+	}
+
+	// 他のインスタンスの投稿への返信は、idがインスタンスの中でしか意味がないので埋めない
+	note.InReplyTo = "https://other.example/users/bob/statuses/99"
+	if got := convertNote(note, actor, account).InReplyToId; got != "" {
+		t.Errorf("in_reply_to_id = %q for a reply to another instance", got)
+	}
+	note.Url = ""
+	if got := convertNote(note, actor, account).Url; got != note.Id {
+		t.Errorf("url = %q, want the id when the note has no url", got)
+	}
+}
+
+func TestConvertNoteVisibility(t *testing.T) {
+	account := Account{Id: "1", UserName: "alice", Host: "example.com"}
+	actor := "https://example.com/users/alice"
+	tests := []struct {
+		name   string
+		to, cc apStrings
+		want   string
+	}{
+		{"public", apStrings{activityStreamsPublic}, nil, "public"},
+		{"unlisted", apStrings{actor + "/followers"}, apStrings{activityStreamsPublic}, "unlisted"},
+		{"private", apStrings{actor + "/followers"}, nil, "private"},
+		{"direct", apStrings{"https://example.com/users/bob"}, nil, "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note := apNote{Id: "https://example.com/users/alice/statuses/1", To: tt.to, Cc: tt.cc}
+			if got := convertNote(note, actor, account).Visibility; got != tt.want {
+				t.Errorf("visibility = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertNoteAttachments(t *testing.T) {
+	account := Account{Id: "1", UserName: "alice", Host: "example.com"}
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"path in the archive", "/media_attachments/files/1/original/a.png", "https://example.com/media_attachments/files/1/original/a.png"},
+		{"https on the instance", "https://example.com/system/a.png", "https://example.com/system/a.png"},
+		{"http", "http://example.com/system/a.png", ""},
+		{"another host", "https://other.example/a.png", ""},
+		{"protocol relative", "//other.example/a.png", ""},
+		{"userinfo", "https://user@example.com/a.png", ""},
+		{"private address", "https://127.0.0.1/a.png", ""},
+		{"file", "file:///etc/passwd", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note := apNote{
+				Id:         "https://example.com/users/alice/statuses/1",
+				Attachment: []apAttachment{{MediaType: "image/png", Url: tt.url, Name: "alt"}},
+			}
+			attachments := convertNote(note, "https://example.com/users/alice", account).MediaAttachments
+			got := ""
+			if len(attachments) == 1 {
+				got = attachments[0].RemoteUrl
+				if attachments[0].Type != "image" || attachments[0].Description != "alt" || attachments[0].StatusId != "1" {
+					t.Errorf("attachment = %+v", attachments[0])
+				}
+			}
+			if got != tt.want {
+				t.Errorf("remote url = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
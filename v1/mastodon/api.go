@@ -0,0 +1,134 @@
+package mastodon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Account struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	Acct        string `json:"acct"`
+	DisplayName string `json:"display_name"`
+	Url         string `json:"url"`
+	Avatar      string `json:"avatar"`
+}
+
+type Tag struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type MediaAttachment struct {
+	Id          string `json:"id"`
+	Type        string `json:"type"`
+	Url         string `json:"url"`
+	PreviewUrl  string `json:"preview_url"`
+	RemoteUrl   string `json:"remote_url"`
+	Description string `json:"description"`
+	Blurhash    string `json:"blurhash"`
+}
+
+// アプリの登録結果と、投稿に付いている投稿元のアプリの両方に使う
+type Application struct {
+	Name         string `json:"name"`
+	Website      string `json:"website"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type Status struct {
+	Id               string            `json:"id"`
+	Account          Account           `json:"account"`
+	Text             string            `json:"text"`
+	Content          string            `json:"content"`
+	SpoilerText      string            `json:"spoiler_text"`
+	Sensitive        bool              `json:"sensitive"`
+	Language         *string           `json:"language"`
+	InReplyToId      *string           `json:"in_reply_to_id"`
+	Reblog           *Status           `json:"reblog"`
+	Url              string            `json:"url"`
+	CreatedAt        time.Time         `json:"created_at"`
+	EditedAt         *time.Time        `json:"edited_at"`
+	Application      *Application      `json:"application"`
+	Poll             json.RawMessage   `json:"poll"`
+	RepliesCount     int               `json:"replies_count"`
+	ReblogsCount     int               `json:"reblogs_count"`
+	FavouritesCount  int               `json:"favourites_count"`
+	Tags             []Tag             `json:"tags"`
+	MediaAttachments []MediaAttachment `json:"media_attachments"`
+	Visibility       string            `json:"visibility"`
+	// APIが返したままのJSON
+	Raw json.RawMessage `json:"-"`
+}
+
+func (s *Status) UnmarshalJSON(b []byte) error {
+	type status Status
+	var v status
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = Status(v)
+	s.Raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+type InstanceUrls struct {
+	// wss://から始まるストリーミングAPIのURL
+	StreamingApi string `json:"streaming_api"`
+}
+
+type Instance struct {
+	Uri  string       `json:"uri"`
+	Urls InstanceUrls `json:"urls"`
+}
+
+// POST /api/v1/apps
+func (c *Client) CreateApp(ctx context.Context, clientName string, redirectUri string) (Application, error) {
+	var app Application
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/apps", nil, url.Values{"client_name": {clientName}, "redirect_uris": {redirectUri}}, &app)
+	return app, err
+}
+
+// 認可コードをアクセストークンに交換する
+func (c *Client) ObtainToken(ctx context.Context, app Application, code string, redirectUri string) (Token, error) {
+	var token Token
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {app.ClientId}, "client_secret": {app.ClientSecret}, "redirect_uri": {redirectUri}}
+	_, err := c.do(ctx, http.MethodPost, "/oauth/token", nil, form, &token)
+	return token, err
+}
+
+func (c *Client) RevokeToken(ctx context.Context, app Application, token string) error {
+	_, err := c.do(ctx, http.MethodPost, "/oauth/revoke", nil, url.Values{"client_id": {app.ClientId}, "client_secret": {app.ClientSecret}, "token": {token}}, nil)
+	return err
+}
+
+func (c *Client) VerifyCredentials(ctx context.Context) (Account, error) {
+	var account Account
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/accounts/verify_credentials", nil, nil, &account)
+	return account, err
+}
+
+// GET /api/v1/accounts/:id/statuses
+func (c *Client) AccountStatuses(ctx context.Context, id string, params url.Values) ([]Status, error) {
+	var statuses []Status
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/accounts/"+url.PathEscape(id)+"/statuses", params, nil, &statuses)
+	return statuses, err
+}
+
+// GET /api/v1/instance
+func (c *Client) Instance(ctx context.Context) (Instance, error) {
+	var instance Instance
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/instance", nil, nil, &instance)
+	return instance, err
+}
@@ -0,0 +1,241 @@
+// MastodonのREST APIのクライアント
+package mastodon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = time.Second
+	// これより長くレート制限の解除を待つことになるなら、待たずにErrRateLimitedを返す
+	defaultMaxRateLimitWait = 10 * time.Minute
+	// エラーのレスポンスはこれ以上読まない
+	maxErrorBodySize = 64 * 1024
+)
+
+// 1つのインスタンスに1つのトークンでアクセスするクライアント
+// レート制限はトークンごとなので、レスポンスのX-RateLimit-*をクライアントが覚えておき、使い切ったら解除まで待つ
+// 複数のgoroutineから同時に使ってよい
+type Client struct {
+	Host string
+	// 空ならAuthorizationヘッダーを付けない
+	Token string
+	// トランスポートを差し替えたいときはここに入れる
+	HttpClient *http.Client
+	// 1回のリクエストのタイムアウト。HttpClientのタイムアウトとは別にかける
+	Timeout time.Duration
+	// 429や5xx、ネットワークエラーのときに再試行する回数。再試行するのはGETだけ
+	MaxRetries int
+	// 最初の再試行までの待ち時間。再試行のたびに倍にする
+	RetryBackoff time.Duration
+	// 続けてリクエストするときに最低限空ける間隔
+	MinInterval      time.Duration
+	MaxRateLimitWait time.Duration
+
+	mu sync.Mutex
+	// X-RateLimit-Remainingを受け取ったことがあればtrue
+	limitKnown  bool
+	remaining   int
+	reset       time.Time
+	lastRequest time.Time
+}
+
+// httpClientがnilならタイムアウトを付けたものを使う
+func NewClient(host string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	return &Client{
+		Host:             host,
+		Token:            token,
+		HttpClient:       httpClient,
+		Timeout:          defaultTimeout,
+		MaxRetries:       defaultMaxRetries,
+		RetryBackoff:     defaultRetryBackoff,
+		MaxRateLimitWait: defaultMaxRateLimitWait,
+	}
+}
+
+// 成功したらレスポンスのJSONをvに入れ、ヘッダーを返す
+// formがnilでなければPOSTのフォームとして送る
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, form url.Values, v interface{}) (http.Header, error) {
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := c.wait(ctx, method, path); err != nil {
+			return nil, err
+		}
+		header, err := c.doOnce(ctx, method, path, query, form, v)
+		if err == nil {
+			return header, nil
+		}
+		// POSTはインスタンスで処理されたかわからないので、やり直すとアプリやトークンが二重にできることがある
+		if attempt >= c.MaxRetries || ctx.Err() != nil || method != http.MethodGet {
+			return nil, err
+		}
+		var apiErr *Error
+		errors.As(err, &apiErr)
+		switch {
+		case apiErr != nil && apiErr.StatusCode == http.StatusTooManyRequests:
+			// 解除の時刻がわかっていればwaitがそれまで待つ
+			if apiErr.Reset.IsZero() {
+				if err := sleep(ctx, backoff); err != nil {
+					return nil, err
+				}
+				backoff *= 2
+			} else if time.Until(apiErr.Reset) > c.MaxRateLimitWait {
+				return nil, err
+			}
+		case apiErr != nil && apiErr.transient() || apiErr == nil && isNetworkError(err):
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+		default:
+			return nil, err
+		}
+	}
+}
+
+// タイムアウトしたか、接続がリセットされたか、レスポンスを読んでいる途中で切れた
+// 名前解決や証明書の検証の失敗、JSONとして読めなかったレスポンスはやり直しても同じなので含めない
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (c *Client) doOnce(ctx context.Context, method string, path string, query url.Values, form url.Values, v interface{}) (http.Header, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	u := url.URL{Scheme: "https", Host: c.Host, Path: path}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	c.mu.Lock()
+	c.lastRequest = time.Now()
+	c.mu.Unlock()
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reset := c.updateRateLimit(resp.Header)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := newError(method, path, resp)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			apiErr.Reset = reset
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && apiErr.Reset.IsZero() {
+				apiErr.Reset = time.Now().Add(time.Duration(s) * time.Second)
+			}
+			if !apiErr.Reset.IsZero() {
+				c.mu.Lock()
+				c.limitKnown = true
+				c.remaining = 0
+				c.reset = apiErr.Reset
+				c.mu.Unlock()
+			}
+		}
+		return nil, apiErr
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// 2xx以外のレスポンスから。{"error": "..."}があればMessageに入れる
+func newError(method string, path string, resp *http.Response) *Error {
+	apiErr := &Error{Method: method, Path: path, StatusCode: resp.StatusCode}
+	var errorBody struct {
+		Error string `json:"error"`
+	}
+	if b, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize)); err == nil && json.Unmarshal(b, &errorBody) == nil {
+		apiErr.Message = errorBody.Error
+	}
+	return apiErr
+}
+
+// X-RateLimit-Resetの時刻を返す
+func (c *Client) updateRateLimit(header http.Header) time.Time {
+	reset, _ := time.Parse(time.RFC3339, header.Get("X-RateLimit-Reset"))
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return reset
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limitKnown = true
+	c.remaining = remaining
+	c.reset = reset
+	return reset
+}
+
+// レート制限を使い切っていれば解除まで、そうでなくてもMinIntervalが経つまで待つ
+func (c *Client) wait(ctx context.Context, method string, path string) error {
+	c.mu.Lock()
+	until := c.lastRequest.Add(c.MinInterval)
+	if c.limitKnown && c.remaining <= 0 && c.reset.After(until) {
+		until = c.reset
+	}
+	c.mu.Unlock()
+	d := time.Until(until)
+	if d <= 0 {
+		return nil
+	}
+	if d > c.MaxRateLimitWait {
+		return &Error{Method: method, Path: path, StatusCode: http.StatusTooManyRequests, Message: "rate limit exhausted", Reset: until}
+	}
+	return sleep(ctx, d)
+}
+
+// 止めるときに待たずに戻れるようにする
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
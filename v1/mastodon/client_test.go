@@ -0,0 +1,86 @@
+package mastodon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", wrap(context.DeadlineExceeded), true},
+		{"connection reset", wrap(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"truncated body", io.ErrUnexpectedEOF, true},
+		{"no such host", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}), false},
+		{"connection refused", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), false},
+		{"cancelled", wrap(context.Canceled), false},
+		{"invalid json", errors.New("invalid character '<' looking for beginning of value"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNetworkError(tt.err); got != tt.want {
+				t.Errorf("isNetworkError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryTooManyRequestsOnlyForGet(t *testing.T) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error":"Too many requests"}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient(strings.TrimPrefix(srv.URL, "https://"), "token", srv.Client())
+	c.MaxRetries = 2
+	c.RetryBackoff = time.Millisecond
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+		want int32
+	}{
+		{"POST", func(ctx context.Context) error {
+			_, err := c.CreateApp(ctx, "activitypublog", "https://blog.example/callback")
+			return err
+		}, 1},
+		{"GET", func(ctx context.Context) error {
+			_, err := c.VerifyCredentials(ctx)
+			return err
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			err := tt.call(context.Background())
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("err = %v, want 429", err)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.want {
+				t.Errorf("requests = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package mastodon
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errors.Isで*Errorがどの種類の失敗かを調べるのに使う
+var (
+	ErrUnauthorized = errors.New("mastodon: unauthorized")
+	ErrForbidden    = errors.New("mastodon: forbidden")
+	ErrNotFound     = errors.New("mastodon: not found")
+	ErrRateLimited  = errors.New("mastodon: rate limited")
+	ErrServer       = errors.New("mastodon: server error")
+)
+
+// インスタンスが2xx以外を返した
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// レスポンスの{"error": "..."}
+	Message string
+	// 429のとき、制限が解除される時刻。わからなければゼロ
+	Reset time.Time
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("mastodon: %s %s: status %d", e.Method, e.Path, e.StatusCode)
+	}
+	return fmt.Sprintf("mastodon: %s %s: status %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// 少し待ってやり直せば成功するかもしれない失敗
+func (e *Error) transient() bool {
+	switch e.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
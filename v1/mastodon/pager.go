@@ -0,0 +1,170 @@
+package mastodon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 1ページで取得できる投稿の最大数
+const MaxStatusesLimit = 40
+
+// Linkヘッダーのrel。nextは古い方へ、prevは新しい方へ進む
+const (
+	RelNext = "next"
+	RelPrev = "prev"
+)
+
+// Linkヘッダー(RFC 8288)をたどって投稿を1ページずつ取得する
+//
+//	pager := client.AccountStatusPages(id, url.Values{"max_id": {oldest}}, mastodon.RelNext)
+//	for pager.Next(ctx) {
+//		save(pager.Page())
+//	}
+//	if err := pager.Err(); err != nil {
+//		...
+//	}
+type StatusPager struct {
+	client *Client
+	rel    string
+	path   string
+	query  url.Values
+	page   []Status
+	err    error
+	done   bool
+}
+
+// paramsにlimitがなければ1ページの最大数にする
+func (c *Client) AccountStatusPages(id string, params url.Values, rel string) *StatusPager {
+	return c.statusPages("/api/v1/accounts/"+url.PathEscape(id)+"/statuses", params, rel)
+}
+
+// GET /api/v1/favourites
+// カーソルはお気に入りのIDで、投稿のIDではない。続きを取得するにはNextParamsを使う
+func (c *Client) FavouritePages(params url.Values, rel string) *StatusPager {
+	return c.statusPages("/api/v1/favourites", params, rel)
+}
+
+// GET /api/v1/bookmarks
+// カーソルはFavouritePagesと同じくブックマークのID
+func (c *Client) BookmarkPages(params url.Values, rel string) *StatusPager {
+	return c.statusPages("/api/v1/bookmarks", params, rel)
+}
+
+func (c *Client) statusPages(path string, params url.Values, rel string) *StatusPager {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	if query.Get("limit") == "" {
+		query.Set("limit", fmt.Sprint(MaxStatusesLimit))
+	}
+	return &StatusPager{client: c, rel: rel, path: path, query: query}
+}
+
+// 次のページを取得する。空のページか、relのリンクがないページで終わる
+func (p *StatusPager) Next(ctx context.Context) bool {
+	if p.done || p.err != nil {
+		return false
+	}
+	var page []Status
+	header, err := p.client.do(ctx, http.MethodGet, p.path, p.query, nil, &page)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if len(page) == 0 {
+		p.done = true
+		return false
+	}
+	p.page = page
+	link, ok := parseLinkHeader(header.Values("Link"))[p.rel]
+	if !ok {
+		p.done = true
+		return true
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		p.err = fmt.Errorf("mastodon: invalid Link header %q: %v", link, err)
+		return true
+	}
+	// トークンを別のホストに送らないようにする
+	if u.Host != "" && !strings.EqualFold(u.Host, p.client.Host) {
+		p.err = fmt.Errorf("mastodon: Link header points to another host %s", u.Host)
+		return true
+	}
+	p.path = u.Path
+	p.query = u.Query()
+	return true
+}
+
+// Nextがtrueを返したあとに呼ぶ
+func (p *StatusPager) Page() []Status {
+	return p.page
+}
+
+// 次のページを取得するときのクエリ。relのリンクがなく、このページで終わりならnil
+// Nextがtrueを返したあとに呼ぶ
+func (p *StatusPager) NextParams() url.Values {
+	if p.done {
+		return nil
+	}
+	return p.query
+}
+
+func (p *StatusPager) Err() error {
+	return p.err
+}
+
+// relからURLへ。<https://example/?max_id=1>; rel="next", <...>; rel="prev"
+func parseLinkHeader(values []string) map[string]string {
+	links := map[string]string{}
+	for _, value := range values {
+		for _, link := range splitLinks(value) {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+			for _, param := range parts[1:] {
+				key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+					continue
+				}
+				// rel="next prev"のように複数書かれることもある
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+					if _, exists := links[strings.ToLower(rel)]; !exists {
+						links[strings.ToLower(rel)] = target
+					}
+				}
+			}
+		}
+	}
+	return links
+}
+
+// URLの中のカンマで分けないように、<>の外のカンマで分ける
+func splitLinks(value string) []string {
+	var links []string
+	depth := 0
+	start := 0
+	for i, r := range value {
+		switch r {
+		case '<':
+			depth++
+		case '>':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				links = append(links, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(links, value[start:])
+}
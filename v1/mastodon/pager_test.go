@@ -0,0 +1,61 @@
+package mastodon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{
+			"next and prev",
+			[]string{`<https://example.com/api/v1/accounts/1/statuses?max_id=10>; rel="next", <https://example.com/api/v1/accounts/1/statuses?min_id=20>; rel="prev"`},
+			map[string]string{
+				"next": "https://example.com/api/v1/accounts/1/statuses?max_id=10",
+				"prev": "https://example.com/api/v1/accounts/1/statuses?min_id=20",
+			},
+		},
+		{
+			"comma in url",
+			[]string{`<https://example.com/?ids=1,2>; rel="next"`},
+			map[string]string{"next": "https://example.com/?ids=1,2"},
+		},
+		{
+			"several headers",
+			[]string{`<https://example.com/?max_id=10>; rel="next"`, `<https://example.com/?min_id=20>; rel="prev"`},
+			map[string]string{"next": "https://example.com/?max_id=10", "prev": "https://example.com/?min_id=20"},
+		},
+		{
+			"unquoted and upper case",
+			[]string{`<https://example.com/?max_id=10>; REL=Next`},
+			map[string]string{"next": "https://example.com/?max_id=10"},
+		},
+		{
+			"several rels",
+			[]string{`<https://example.com/?max_id=10>; rel="next last"`},
+			map[string]string{"next": "https://example.com/?max_id=10", "last": "https://example.com/?max_id=10"},
+		},
+		{
+			"first one wins",
+			[]string{`<https://example.com/?max_id=10>; rel="next", <https://example.com/?max_id=5>; rel="next"`},
+			map[string]string{"next": "https://example.com/?max_id=10"},
+		},
+		{
+			"broken",
+			[]string{`https://example.com/?max_id=10; rel="next"`, `<https://example.com/?max_id=10>; title="next"`},
+			map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLinkHeader(tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLinkHeader(%q) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
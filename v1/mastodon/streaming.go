@@ -0,0 +1,269 @@
+package mastodon
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ストリーミングAPIのイベントの種類のうち、投稿に関するもの
+// 通知やフィルターの変更など、これ以外の種類のイベントも届く
+const (
+	EventUpdate       = "update"
+	EventStatusUpdate = "status.update"
+	EventDelete       = "delete"
+)
+
+const (
+	// WebSocketでこの間隔ごとにpingを送り、送れなくなったら切れたとみなす
+	webSocketPingInterval = 30 * time.Second
+	// SSEはインスタンスが15秒ごとにコメントを送ってくるので、この間何も届かなければ切れたとみなす
+	eventStreamIdleTimeout = 2 * time.Minute
+)
+
+type Event struct {
+	Event string
+	// update, status.updateなら投稿のJSON、deleteなら投稿のID
+	Payload string
+}
+
+// update, status.updateの投稿
+func (e Event) Status() (Status, error) {
+	var status Status
+	if err := json.Unmarshal([]byte(e.Payload), &status); err != nil {
+		return status, fmt.Errorf("mastodon: invalid %s payload: %v", e.Event, err)
+	}
+	return status, nil
+}
+
+// 開いたストリーム。切れるとNextがエラーを返す
+// Nextは1つのgoroutineから呼び、Closeはどのgoroutineから呼んでもよい
+type Stream interface {
+	Next() (Event, error)
+	Close() error
+}
+
+// ログインしているユーザーのホームタイムラインと通知のストリームを開く
+// WebSocketでつながらなければServer-Sent Eventsで開く。ctxがキャンセルされるとストリームも閉じる
+func (c *Client) StreamUser(ctx context.Context) (Stream, error) {
+	base := c.streamingBase(ctx)
+	stream, wsErr := c.dialWebSocket(ctx, base, "user")
+	if wsErr == nil {
+		return stream, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	stream, err := c.openEventStream(ctx, base, "user")
+	if err != nil {
+		return nil, fmt.Errorf("mastodon: streaming: websocket: %v, sse: %w", wsErr, err)
+	}
+	return stream, nil
+}
+
+// ストリーミングAPIは別のホストで動いていることがあるので、インスタンスの情報から探す
+// わからなければインスタンスと同じホストにする
+func (c *Client) streamingBase(ctx context.Context) *url.URL {
+	base := &url.URL{Scheme: "wss", Host: c.Host}
+	instance, err := c.Instance(ctx)
+	if err != nil {
+		return base
+	}
+	u, err := url.Parse(instance.Urls.StreamingApi)
+	// トークンを送るので、暗号化されていないURLは使わない
+	if err != nil || u.Scheme != "wss" || u.Host == "" {
+		return base
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}
+}
+
+func (c *Client) tlsConfig() *tls.Config {
+	if t, ok := c.HttpClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		return t.TLSClientConfig.Clone()
+	}
+	return &tls.Config{}
+}
+
+func (c *Client) dialWebSocket(ctx context.Context, base *url.URL, stream string) (Stream, error) {
+	u := *base
+	u.Path = "/api/v1/streaming"
+	u.RawQuery = url.Values{"stream": {stream}}.Encode()
+	config, err := websocket.NewConfig(u.String(), "https://"+c.Host)
+	if err != nil {
+		return nil, err
+	}
+	// access_tokenをクエリに書くとログに残りやすいので、ヘッダーで送る
+	config.Header.Set("Authorization", "Bearer "+c.Token)
+	config.TlsConfig = c.tlsConfig()
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: c.Timeout}, Config: config.TlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// ハンドシェイクはctxを受け取らないので、タイムアウトだけかけておく
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.PingFrame
+	s := &webSocketStream{ws: ws, done: make(chan struct{})}
+	go s.keepAlive(ctx)
+	return s, nil
+}
+
+type webSocketStream struct {
+	ws        *websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pingに応えるのはwebsocketのパッケージがする
+func (s *webSocketStream) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.Close()
+			return
+		case <-ticker.C:
+			if _, err := s.ws.Write(nil); err != nil {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *webSocketStream) Next() (Event, error) {
+	var data []byte
+	if err := websocket.Message.Receive(s.ws, &data); err != nil {
+		return Event{}, err
+	}
+	var message struct {
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return Event{}, fmt.Errorf("mastodon: invalid streaming message: %v", err)
+	}
+	event := Event{Event: message.Event}
+	// payloadはJSONを文字列にしたもの。文字列でなければそのまま渡す
+	if err := json.Unmarshal(message.Payload, &event.Payload); err != nil {
+		event.Payload = string(message.Payload)
+	}
+	return event, nil
+}
+
+func (s *webSocketStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.ws.Close()
+	})
+	return err
+}
+
+func (c *Client) openEventStream(ctx context.Context, base *url.URL, stream string) (Stream, error) {
+	u := *base
+	u.Scheme = "https"
+	u.Path = "/api/v1/streaming/" + stream
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	// http.ClientのTimeoutは本文を読み終わるまでにかかるので、ヘッダーが届くまでだけ自分でかける
+	httpClient := *c.HttpClient
+	httpClient.Timeout = 0
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		cancel()
+		return nil, newError(http.MethodGet, u.Path, resp)
+	}
+	timer.Reset(eventStreamIdleTimeout)
+	return &eventStream{body: resp.Body, r: bufio.NewReader(resp.Body), cancel: cancel, idle: timer}, nil
+}
+
+type eventStream struct {
+	body   io.ReadCloser
+	r      *bufio.Reader
+	cancel context.CancelFunc
+	idle   *time.Timer
+}
+
+// event: update
+// data: {...}
+// (空行)
+func (s *eventStream) Next() (Event, error) {
+	var event Event
+	var data []string
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return Event{}, err
+		}
+		s.idle.Reset(eventStreamIdleTimeout)
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if event.Event != "" {
+				event.Payload = strings.Join(data, "\n")
+				return event, nil
+			}
+			data = nil
+		case strings.HasPrefix(line, ":"):
+			// 接続を保つためのコメント
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event.Event = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+}
+
+func (s *eventStream) Close() error {
+	s.idle.Stop()
+	s.cancel()
+	return s.body.Close()
+}
@@ -0,0 +1,243 @@
+package activitypublog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const maxMediaFetchAttempts = 3
+
+// メディアのURLは他人の投稿やアップロードされたアーカイブから来るので、このサーバーの内側には取りに行かない
+// 名前解決した後のアドレスを接続する直前に確かめるので、DNSで内側のアドレスを返されても、リダイレクトされても防げる
+func newMediaHttpClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIp(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", address)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// プロキシを通すと確かめるのがプロキシのアドレスになってしまう
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("refusing to follow a redirect to a non-https URL")
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCidr("0.0.0.0/8"),
+	// キャリアグレードNAT
+	mustParseCidr("100.64.0.0/10"),
+}
+
+func mustParseCidr(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// プライベート・ループバック・リンクローカルなどのアドレスならfalse
+func isPublicIp(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// 取り込んだ投稿のメディアのうち、まだ保存していないものをダウンロードしてBlobStoreに入れる
+func (s *Server) archivePendingMedia(ctx context.Context, accountId string, host string) error {
+	attachments, err := dSelectPendingMediaAttachments(ctx, s.db, accountId, host, maxMediaFetchAttempts)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		attachment.FetchAttempts++
+		attachment.FetchError = ""
+		// 前回どちらかだけ保存できていれば、残った方だけを取りに行く
+		if attachment.BlobHash == "" {
+			hash, contentType, err := s.archiveBlob(ctx, attachment.RemoteUrl)
+			if err != nil {
+				attachment.FetchError = err.Error()
+			} else {
+				attachment.BlobHash = hash
+				attachment.ContentType = contentType
+			}
+		}
+		if attachment.PreviewRemoteUrl == "" || attachment.PreviewRemoteUrl == attachment.RemoteUrl {
+			attachment.PreviewBlobHash = attachment.BlobHash
+			attachment.PreviewContentType = attachment.ContentType
+		} else if attachment.PreviewBlobHash == "" {
+			hash, contentType, err := s.archiveBlob(ctx, attachment.PreviewRemoteUrl)
+			if err != nil && attachment.FetchError == "" {
+				attachment.FetchError = err.Error()
+			} else if err == nil {
+				attachment.PreviewBlobHash = hash
+				attachment.PreviewContentType = contentType
+			}
+		}
+		if err := dUpdateMediaAttachmentBlob(ctx, s.db, attachment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// URLからダウンロードして保存する。httpsのURLだけを受け付け、MaxBytesを超えたら途中でやめる
+func (s *Server) archiveBlob(ctx context.Context, rawUrl string) (string, string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", "", fmt.Errorf("archiveBlob: refusing to fetch %q: not an https URL", rawUrl)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", "", fmt.Errorf("archiveBlob: %v", err)
+	}
+	resp, err := s.mediaClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("archiveBlob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("archiveBlob: GET %s: status %d", rawUrl, resp.StatusCode)
+	}
+	if resp.ContentLength > s.config.Media.MaxBytes {
+		return "", "", fmt.Errorf("archiveBlob: GET %s: %d bytes is larger than %d bytes", rawUrl, resp.ContentLength, s.config.Media.MaxBytes)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	hash, err := storeBlob(ctx, s.blobStore, resp.Body, contentType, s.config.Media.MaxBytes)
+	if err != nil {
+		return "", "", err
+	}
+	return hash, contentType, nil
+}
+
+// /mediaで返すContent-Type。インスタンスが送ってきたものをそのまま使うと、text/htmlやSVGで
+// このサーバーのオリジンでスクリプトを動かせてしまうので、SVG以外の画像と動画と音声だけにする
+func servableMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "image/svg+xml" {
+		return "application/octet-stream"
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return mediaType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// 一時ファイルに書き出しながらハッシュを取り、同じ内容がまだなければ保存する
+// maxBytesより大きければ読むのをやめてエラーにする
+func storeBlob(ctx context.Context, store BlobStore, r io.Reader, contentType string, maxBytes int64) (string, error) {
+	f, err := os.CreateTemp("", "activitypublog-media-")
+	if err != nil {
+		return "", fmt.Errorf("storeBlob: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("storeBlob: %v", err)
+	}
+	if size > maxBytes {
+		return "", fmt.Errorf("storeBlob: larger than %d bytes", maxBytes)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	exists, err := store.Exists(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return hash, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("storeBlob: %v", err)
+	}
+	if err := store.Put(ctx, hash, contentType, f, size); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// 表示する投稿にメディアを載せる。ブーストなら元の投稿の写しも載せる
+func (s *Server) attachMedia(ctx context.Context, statuses []Status) ([]Status, error) {
+	if len(statuses) == 0 {
+		return statuses, nil
+	}
+	// 自分の投稿をブーストしたときは、添付は元の投稿の方に保存されている
+	lookup := append([]Status(nil), statuses...)
+	for _, status := range statuses {
+		if status.ReblogId != "" {
+			lookup = append(lookup, Status{Id: status.ReblogId, Host: status.Host})
+		}
+	}
+	attachments, err := dSelectMediaAttachmentsByStatuses(ctx, s.db, lookup)
+	if err != nil {
+		return nil, err
+	}
+	byStatus := map[string][]MediaAttachment{}
+	for _, attachment := range attachments {
+		key := attachment.Host + "/" + attachment.StatusId
+		byStatus[key] = append(byStatus[key], attachment)
+	}
+	reblogs, err := dSelectReblogsByStatuses(ctx, s.db, statuses)
+	if err != nil {
+		return nil, err
+	}
+	reblogByStatus := map[string]Reblog{}
+	for _, reblog := range reblogs {
+		reblogByStatus[reblog.Host+"/"+reblog.StatusId] = reblog
+	}
+	for i, status := range statuses {
+		statuses[i].MediaAttachments = byStatus[status.Host+"/"+status.Id]
+		reblog, ok := reblogByStatus[status.Host+"/"+status.Id]
+		if !ok {
+			continue
+		}
+		if len(statuses[i].MediaAttachments) == 0 {
+			statuses[i].MediaAttachments = byStatus[status.Host+"/"+status.ReblogId]
+		}
+		reblog.MediaAttachments = statuses[i].MediaAttachments
+		statuses[i].Reblog = &reblog
+	}
+	return statuses, nil
+}
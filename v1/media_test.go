@@ -0,0 +1,114 @@
+package activitypublog
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestIsPublicIp(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIp(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIp(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestServableMediaType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"image/png", "image/png"},
+		{"video/mp4; codecs=avc1", "video/mp4"},
+		{"audio/mpeg", "audio/mpeg"},
+		{"image/svg+xml", "application/octet-stream"},
+		{"text/html", "application/octet-stream"},
+		{"", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := servableMediaType(tt.in); got != tt.want {
+			t.Errorf("servableMediaType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 保存できた方はもう取りに行かず、残った方だけをやり直す
+func TestArchivePendingMediaRetriesEachPart(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		if r.URL.Path == "/small.png" && n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	// テストのサーバーはループバックにあるので、アドレスを確かめないクライアントを使う
+	s.mediaClient = srv.Client()
+
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	statuses := testStatuses("1", testHost, "10")
+	statuses[0].MediaAttachments = []MediaAttachment{{Id: "m1", StatusId: "10", Host: testHost, Type: "image", RemoteUrl: srv.URL + "/original.png", PreviewRemoteUrl: srv.URL + "/small.png"}}
+	if _, err := s.store.UpsertStatuses(ctx, statuses, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	selectAttachment := func() MediaAttachment {
+		t.Helper()
+		attachments, err := dSelectMediaAttachmentsByStatuses(ctx, s.db, statuses)
+		if err != nil || len(attachments) != 1 {
+			t.Fatalf("attachments = %v, %v", attachments, err)
+		}
+		return attachments[0]
+	}
+
+	if err := s.archivePendingMedia(ctx, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	if a := selectAttachment(); a.BlobHash == "" || a.PreviewBlobHash != "" || a.FetchError == "" {
+		t.Errorf("after the first try = %+v, want only the original", a)
+	}
+	if err := s.archivePendingMedia(ctx, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	if a := selectAttachment(); a.BlobHash == "" || a.PreviewBlobHash == "" || a.FetchError != "" || a.FetchAttempts != 2 {
+		t.Errorf("after the retry = %+v, want both", a)
+	}
+	if err := s.archivePendingMedia(ctx, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	if requests["/original.png"] != 1 || requests["/small.png"] != 2 {
+		t.Errorf("requests = %v, want the original once and the preview twice", requests)
+	}
+}
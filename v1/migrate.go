@@ -0,0 +1,109 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/uptrace/bun/migrate"
+)
+
+const migrationsTable = "schema_migrations"
+const migrationLocksTable = "schema_migration_locks"
+
+// 複数のプロセスが同時に起動してもマイグレーションは1つずつしか走らないようにする
+const migrationLockName = "activitypublog_schema_migrations"
+const migrationLockTimeoutSeconds = 300
+
+func newMigrator(s Store) *migrate.Migrator {
+	return migrate.NewMigrator(s.DB(), s.Migrations(),
+		migrate.WithTableName(migrationsTable),
+		migrate.WithLocksTableName(migrationLocksTable),
+		migrate.WithMarkAppliedOnSuccess(true),
+	)
+}
+
+// 未適用のマイグレーションをすべて適用する
+func migrateUp(ctx context.Context, s Store) (*migrate.MigrationGroup, error) {
+	migrator := newMigrator(s)
+	var group *migrate.MigrationGroup
+	err := s.LockMigrations(ctx, func() error {
+		if err := migrator.Init(ctx); err != nil {
+			return err
+		}
+		var err error
+		group, err = migrator.Migrate(ctx)
+		return err
+	})
+	if err != nil {
+		return group, fmt.Errorf("migrateUp: %v", err)
+	}
+	return group, nil
+}
+
+// 最後にまとめて適用したマイグレーションを取り消す
+func migrateDown(ctx context.Context, s Store) (*migrate.MigrationGroup, error) {
+	migrator := newMigrator(s)
+	var group *migrate.MigrationGroup
+	err := s.LockMigrations(ctx, func() error {
+		if err := migrator.Init(ctx); err != nil {
+			return err
+		}
+		var err error
+		group, err = migrator.Rollback(ctx)
+		return err
+	})
+	if err != nil {
+		return group, fmt.Errorf("migrateDown: %v", err)
+	}
+	return group, nil
+}
+
+// server migrate [up|down|status]
+func RunMigrate(config Config, command string) {
+	ctx := context.Background()
+	s, err := OpenStore(config.DatabaseUrl)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	switch command {
+	case "", "up":
+		var group *migrate.MigrationGroup
+		group, err = migrateUp(ctx, s)
+		if err == nil {
+			if group.IsZero() {
+				fmt.Println("there are no new migrations to run")
+			} else {
+				fmt.Printf("migrated to %s\n", group)
+			}
+		}
+	case "down":
+		var group *migrate.MigrationGroup
+		group, err = migrateDown(ctx, s)
+		if err == nil {
+			if group.IsZero() {
+				fmt.Println("there are no migrations to roll back")
+			} else {
+				fmt.Printf("rolled back %s\n", group)
+			}
+		}
+	case "status":
+		migrator := newMigrator(s)
+		if err = migrator.Init(ctx); err == nil {
+			var ms migrate.MigrationSlice
+			ms, err = migrator.MigrationsWithStatus(ctx)
+			if err == nil {
+				fmt.Printf("applied: %s\n", ms.Applied())
+				fmt.Printf("pending: %s\n", ms.Unapplied())
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q. use up, down or status\n", command)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+// スキーマのマイグレーション
+// ファイル名は 年月日時分秒_名前.up.sql / .down.sql で、この順に適用する
+// 1つのファイルに複数の文を書くときは --bun:split で区切る
+// DBごとにディレクトリを分ける。postgresとsqliteはMySQLの最新のスキーマから始めている
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/uptrace/bun/migrate"
+)
+
+//go:embed mysql/*.sql postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+var MySQL = migrate.NewMigrations()
+var Postgres = migrate.NewMigrations()
+var SQLite = migrate.NewMigrations()
+
+func init() {
+	discover(MySQL, "mysql")
+	discover(Postgres, "postgres")
+	discover(SQLite, "sqlite")
+}
+
+func discover(m *migrate.Migrations, dir string) {
+	sub, err := fs.Sub(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	if err := m.Discover(sub); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS `account`
+
+--bun:split
+
+DROP TABLE IF EXISTS `app`
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS `app` (
+  `host` VARCHAR(255) NOT NULL,
+  `client_id` VARCHAR(255),
+  `client_secret` VARCHAR(255),
+  PRIMARY KEY (`host`)
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `account` (
+  `id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `user_name` VARCHAR(255),
+  `all_fetched` BOOLEAN DEFAULT true,
+  `public` BOOLEAN DEFAULT false,
+  `show_unlisted` BOOLEAN,
+  `show_private` BOOLEAN,
+  `show_direct` BOOLEAN,
+  PRIMARY KEY (`id`, `host`)
+)
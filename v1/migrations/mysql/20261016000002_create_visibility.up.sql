@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS `visibility` (
+  `visibility` VARCHAR(255) NOT NULL,
+  PRIMARY KEY (`visibility`)
+)
+
+--bun:split
+
+INSERT IGNORE INTO `visibility` (`visibility`) VALUES ('public'), ('unlisted'), ('private'), ('direct')
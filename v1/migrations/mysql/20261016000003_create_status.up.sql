@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `status` (
+  `id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `account_id` VARCHAR(255),
+  `text` VARCHAR(10000),
+  `url` VARCHAR(255),
+  `created_at` DATETIME,
+  `visibility` VARCHAR(255),
+  PRIMARY KEY (`id`, `host`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE,
+  FOREIGN KEY (`visibility`) REFERENCES `visibility` (`visibility`) ON DELETE CASCADE ON UPDATE CASCADE
+)
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS `session`
+
+--bun:split
+
+DROP TABLE IF EXISTS `credential`
+
+--bun:split
+
+DROP TABLE IF EXISTS `sync_state`
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS `sync_state` (
+  `account_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `last_run_at` DATETIME,
+  `next_run_at` DATETIME,
+  `last_error` VARCHAR(1000),
+  PRIMARY KEY (`account_id`, `host`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `credential` (
+  `account_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `encrypted_token` VARCHAR(1000),
+  `scope` VARCHAR(255),
+  `created_at` DATETIME,
+  PRIMARY KEY (`account_id`, `host`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `session` (
+  `id` VARCHAR(255) NOT NULL,
+  `account_id` VARCHAR(255),
+  `host` VARCHAR(255),
+  `user_name` VARCHAR(255),
+  `acct` VARCHAR(255),
+  `display_name` VARCHAR(255),
+  `avatar` VARCHAR(1000),
+  `url` VARCHAR(1000),
+  `csrf_token` VARCHAR(255),
+  `created_at` DATETIME,
+  `expires_at` DATETIME,
+  PRIMARY KEY (`id`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE
+)
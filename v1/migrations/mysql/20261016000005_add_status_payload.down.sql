@@ -0,0 +1,15 @@
+ALTER TABLE `status`
+  DROP COLUMN `content`,
+  DROP COLUMN `spoiler_text`,
+  DROP COLUMN `sensitive`,
+  DROP COLUMN `language`,
+  DROP COLUMN `in_reply_to_id`,
+  DROP COLUMN `reblog_id`,
+  DROP COLUMN `edited_at`,
+  DROP COLUMN `application_name`,
+  DROP COLUMN `application_website`,
+  DROP COLUMN `poll`,
+  DROP COLUMN `replies_count`,
+  DROP COLUMN `reblogs_count`,
+  DROP COLUMN `favourites_count`,
+  DROP COLUMN `raw`
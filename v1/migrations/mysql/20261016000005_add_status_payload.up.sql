@@ -0,0 +1,15 @@
+ALTER TABLE `status`
+  ADD COLUMN `content` TEXT AFTER `text`,
+  ADD COLUMN `spoiler_text` VARCHAR(1000) AFTER `content`,
+  ADD COLUMN `sensitive` BOOLEAN AFTER `spoiler_text`,
+  ADD COLUMN `language` VARCHAR(255) AFTER `sensitive`,
+  ADD COLUMN `in_reply_to_id` VARCHAR(255) AFTER `language`,
+  ADD COLUMN `reblog_id` VARCHAR(255) AFTER `in_reply_to_id`,
+  ADD COLUMN `edited_at` DATETIME AFTER `created_at`,
+  ADD COLUMN `application_name` VARCHAR(255) AFTER `edited_at`,
+  ADD COLUMN `application_website` VARCHAR(1000) AFTER `application_name`,
+  ADD COLUMN `poll` JSON AFTER `application_website`,
+  ADD COLUMN `replies_count` BIGINT AFTER `poll`,
+  ADD COLUMN `reblogs_count` BIGINT AFTER `replies_count`,
+  ADD COLUMN `favourites_count` BIGINT AFTER `reblogs_count`,
+  ADD COLUMN `raw` JSON
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS `media_attachment` (
+  `id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `status_id` VARCHAR(255),
+  `type` VARCHAR(255),
+  `remote_url` VARCHAR(2000),
+  `preview_remote_url` VARCHAR(2000),
+  `description` TEXT,
+  `blurhash` VARCHAR(255),
+  `blob_hash` VARCHAR(255),
+  `content_type` VARCHAR(255),
+  `preview_blob_hash` VARCHAR(255),
+  `preview_content_type` VARCHAR(255),
+  `fetch_attempts` BIGINT,
+  `fetch_error` VARCHAR(1000),
+  PRIMARY KEY (`id`, `host`),
+  INDEX `media_attachment_blob_hash` (`blob_hash`),
+  INDEX `media_attachment_preview_blob_hash` (`preview_blob_hash`),
+  FOREIGN KEY (`status_id`, `host`) REFERENCES `status` (`id`, `host`) ON DELETE CASCADE
+)
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS `status_tag`
+
+--bun:split
+
+DROP TABLE IF EXISTS `tag`
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `tag` (
+  `name` VARCHAR(255) NOT NULL,
+  PRIMARY KEY (`name`)
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `status_tag` (
+  `status_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `tag_name` VARCHAR(255) NOT NULL,
+  PRIMARY KEY (`status_id`, `host`, `tag_name`),
+  INDEX `status_tag_tag_name` (`tag_name`),
+  FOREIGN KEY (`status_id`, `host`) REFERENCES `status` (`id`, `host`) ON DELETE CASCADE,
+  FOREIGN KEY (`tag_name`) REFERENCES `tag` (`name`) ON DELETE CASCADE
+)
@@ -0,0 +1 @@
+DROP INDEX `status_text_fulltext` ON `status`
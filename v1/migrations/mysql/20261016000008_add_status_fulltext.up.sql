@@ -0,0 +1 @@
+CREATE FULLTEXT INDEX `status_text_fulltext` ON `status` (`text`, `spoiler_text`) WITH PARSER ngram
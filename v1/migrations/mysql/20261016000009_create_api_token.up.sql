@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `api_token` (
+  `id` VARCHAR(255) NOT NULL,
+  `account_id` VARCHAR(255),
+  `host` VARCHAR(255),
+  `name` VARCHAR(255),
+  `token_hash` VARCHAR(255),
+  `created_at` DATETIME,
+  `last_used_at` DATETIME,
+  PRIMARY KEY (`id`),
+  UNIQUE (`token_hash`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE
+)
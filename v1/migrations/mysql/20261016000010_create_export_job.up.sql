@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `export_job` (
+  `id` VARCHAR(255) NOT NULL,
+  `account_id` VARCHAR(255),
+  `host` VARCHAR(255),
+  `state` VARCHAR(255),
+  `status_count` BIGINT,
+  `size` BIGINT,
+  `error` VARCHAR(1000),
+  `created_at` DATETIME,
+  `finished_at` DATETIME,
+  PRIMARY KEY (`id`),
+  INDEX `export_job_state` (`state`),
+  FOREIGN KEY (`account_id`, `host`) REFERENCES `account` (`id`, `host`) ON DELETE CASCADE
+)
@@ -0,0 +1,14 @@
+ALTER TABLE `sync_job`
+  DROP COLUMN `kind`,
+  DROP COLUMN `deleted_count`
+
+--bun:split
+
+ALTER TABLE `account`
+  DROP COLUMN `hide_deleted`
+
+--bun:split
+
+ALTER TABLE `status`
+  DROP INDEX `status_deleted_at`,
+  DROP COLUMN `deleted_at`
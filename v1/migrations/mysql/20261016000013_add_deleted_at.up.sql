@@ -0,0 +1,14 @@
+ALTER TABLE `status`
+  ADD COLUMN `deleted_at` DATETIME AFTER `edited_at`,
+  ADD INDEX `status_deleted_at` (`account_id`, `host`, `deleted_at`)
+
+--bun:split
+
+ALTER TABLE `account`
+  ADD COLUMN `hide_deleted` BOOLEAN DEFAULT false AFTER `show_direct`
+
+--bun:split
+
+ALTER TABLE `sync_job`
+  ADD COLUMN `kind` VARCHAR(255) DEFAULT 'backfill' AFTER `host`,
+  ADD COLUMN `deleted_count` BIGINT DEFAULT 0 AFTER `oldest_id`
@@ -0,0 +1,6 @@
+ALTER TABLE `account`
+  DROP COLUMN `show_reblogs`
+
+--bun:split
+
+DROP TABLE IF EXISTS `reblog`
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `reblog` (
+  `status_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `url` VARCHAR(1000),
+  `account_acct` VARCHAR(255),
+  `account_display_name` VARCHAR(1000),
+  `account_url` VARCHAR(1000),
+  `account_avatar` VARCHAR(1000),
+  `text` VARCHAR(10000),
+  `content` TEXT,
+  `spoiler_text` VARCHAR(1000),
+  `sensitive` BOOLEAN,
+  `created_at` DATETIME,
+  PRIMARY KEY (`status_id`, `host`),
+  FOREIGN KEY (`status_id`, `host`) REFERENCES `status` (`id`, `host`) ON DELETE CASCADE
+)
+
+--bun:split
+
+ALTER TABLE `account`
+  ADD COLUMN `show_reblogs` BOOLEAN DEFAULT false AFTER `hide_deleted`
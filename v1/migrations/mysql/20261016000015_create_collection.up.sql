@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `collection_item` (
+  `account_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `collection` VARCHAR(255) NOT NULL,
+  `status_id` VARCHAR(255) NOT NULL,
+  `added_at` DATETIME,
+  PRIMARY KEY (`account_id`, `host`, `collection`, `status_id`),
+  INDEX `collection_item_status` (`status_id`, `host`),
+  FOREIGN KEY (`status_id`, `host`) REFERENCES `status` (`id`, `host`) ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `collection_state` (
+  `account_id` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL,
+  `collection` VARCHAR(255) NOT NULL,
+  `max_id` VARCHAR(255) DEFAULT '',
+  `all_fetched` BOOLEAN DEFAULT false,
+  PRIMARY KEY (`account_id`, `host`, `collection`)
+)
@@ -0,0 +1,2 @@
+ALTER TABLE `status`
+  DROP COLUMN `source`
@@ -0,0 +1,8 @@
+ALTER TABLE `status`
+  ADD COLUMN `source` VARCHAR(255) NOT NULL DEFAULT 'api' AFTER `deleted_at`
+
+--bun:split
+
+UPDATE `status` SET `source` = 'collection'
+WHERE EXISTS (SELECT 1 FROM `collection_item` WHERE `collection_item`.`status_id` = `status`.`id` AND `collection_item`.`host` = `status`.`host`)
+  AND NOT EXISTS (SELECT 1 FROM `credential` WHERE `credential`.`account_id` = `status`.`account_id` AND `credential`.`host` = `status`.`host`)
@@ -0,0 +1,188 @@
+CREATE TABLE IF NOT EXISTS "app" (
+  "host" VARCHAR(255) NOT NULL,
+  "client_id" VARCHAR(255),
+  "client_secret" VARCHAR(255),
+  PRIMARY KEY ("host")
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "account" (
+  "id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "user_name" VARCHAR(255),
+  "all_fetched" BOOLEAN DEFAULT true,
+  "public" BOOLEAN DEFAULT false,
+  "show_unlisted" BOOLEAN,
+  "show_private" BOOLEAN,
+  "show_direct" BOOLEAN,
+  PRIMARY KEY ("id", "host")
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "visibility" (
+  "visibility" VARCHAR(255) NOT NULL,
+  PRIMARY KEY ("visibility")
+)
+
+--bun:split
+
+INSERT INTO "visibility" ("visibility") VALUES ('public'), ('unlisted'), ('private'), ('direct') ON CONFLICT DO NOTHING
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "status" (
+  "id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "account_id" VARCHAR(255),
+  "text" VARCHAR(10000),
+  "content" TEXT,
+  "spoiler_text" VARCHAR(1000),
+  "sensitive" BOOLEAN,
+  "language" VARCHAR(255),
+  "in_reply_to_id" VARCHAR(255),
+  "reblog_id" VARCHAR(255),
+  "url" VARCHAR(255),
+  "created_at" TIMESTAMP,
+  "edited_at" TIMESTAMP,
+  "application_name" VARCHAR(255),
+  "application_website" VARCHAR(1000),
+  "poll" JSON,
+  "replies_count" BIGINT,
+  "reblogs_count" BIGINT,
+  "favourites_count" BIGINT,
+  "visibility" VARCHAR(255),
+  "raw" JSON,
+  PRIMARY KEY ("id", "host"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE,
+  FOREIGN KEY ("visibility") REFERENCES "visibility" ("visibility") ON DELETE CASCADE ON UPDATE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "sync_state" (
+  "account_id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "last_run_at" TIMESTAMP,
+  "next_run_at" TIMESTAMP,
+  "last_error" VARCHAR(1000),
+  PRIMARY KEY ("account_id", "host"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "credential" (
+  "account_id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "encrypted_token" VARCHAR(1000),
+  "scope" VARCHAR(255),
+  "created_at" TIMESTAMP,
+  PRIMARY KEY ("account_id", "host"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "session" (
+  "id" VARCHAR(255) NOT NULL,
+  "account_id" VARCHAR(255),
+  "host" VARCHAR(255),
+  "user_name" VARCHAR(255),
+  "acct" VARCHAR(255),
+  "display_name" VARCHAR(255),
+  "avatar" VARCHAR(1000),
+  "url" VARCHAR(1000),
+  "csrf_token" VARCHAR(255),
+  "created_at" TIMESTAMP,
+  "expires_at" TIMESTAMP,
+  PRIMARY KEY ("id"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "media_attachment" (
+  "id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "status_id" VARCHAR(255),
+  "type" VARCHAR(255),
+  "remote_url" VARCHAR(2000),
+  "preview_remote_url" VARCHAR(2000),
+  "description" TEXT,
+  "blurhash" VARCHAR(255),
+  "blob_hash" VARCHAR(255),
+  "content_type" VARCHAR(255),
+  "preview_blob_hash" VARCHAR(255),
+  "preview_content_type" VARCHAR(255),
+  "fetch_attempts" BIGINT,
+  "fetch_error" VARCHAR(1000),
+  PRIMARY KEY ("id", "host"),
+  FOREIGN KEY ("status_id", "host") REFERENCES "status" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "media_attachment_blob_hash" ON "media_attachment" ("blob_hash")
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "media_attachment_preview_blob_hash" ON "media_attachment" ("preview_blob_hash")
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "tag" (
+  "name" VARCHAR(255) NOT NULL,
+  PRIMARY KEY ("name")
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "status_tag" (
+  "status_id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "tag_name" VARCHAR(255) NOT NULL,
+  PRIMARY KEY ("status_id", "host", "tag_name"),
+  FOREIGN KEY ("status_id", "host") REFERENCES "status" ("id", "host") ON DELETE CASCADE,
+  FOREIGN KEY ("tag_name") REFERENCES "tag" ("name") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "status_tag_tag_name" ON "status_tag" ("tag_name")
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "api_token" (
+  "id" VARCHAR(255) NOT NULL,
+  "account_id" VARCHAR(255),
+  "host" VARCHAR(255),
+  "name" VARCHAR(255),
+  "token_hash" VARCHAR(255),
+  "created_at" TIMESTAMP,
+  "last_used_at" TIMESTAMP,
+  PRIMARY KEY ("id"),
+  UNIQUE ("token_hash"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "export_job" (
+  "id" VARCHAR(255) NOT NULL,
+  "account_id" VARCHAR(255),
+  "host" VARCHAR(255),
+  "state" VARCHAR(255),
+  "status_count" BIGINT,
+  "size" BIGINT,
+  "error" VARCHAR(1000),
+  "created_at" TIMESTAMP,
+  "finished_at" TIMESTAMP,
+  PRIMARY KEY ("id"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "export_job_state" ON "export_job" ("state")
@@ -0,0 +1,15 @@
+ALTER TABLE "sync_job"
+  DROP COLUMN "kind",
+  DROP COLUMN "deleted_count"
+
+--bun:split
+
+ALTER TABLE "account" DROP COLUMN "hide_deleted"
+
+--bun:split
+
+DROP INDEX IF EXISTS "status_deleted_at"
+
+--bun:split
+
+ALTER TABLE "status" DROP COLUMN "deleted_at"
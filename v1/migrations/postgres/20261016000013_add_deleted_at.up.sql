@@ -0,0 +1,15 @@
+ALTER TABLE "status" ADD COLUMN "deleted_at" TIMESTAMP
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "status_deleted_at" ON "status" ("account_id", "host", "deleted_at")
+
+--bun:split
+
+ALTER TABLE "account" ADD COLUMN "hide_deleted" BOOLEAN DEFAULT false
+
+--bun:split
+
+ALTER TABLE "sync_job"
+  ADD COLUMN "kind" VARCHAR(255) DEFAULT 'backfill',
+  ADD COLUMN "deleted_count" BIGINT DEFAULT 0
@@ -0,0 +1,45 @@
+DROP TABLE IF EXISTS "export_job"
+
+--bun:split
+
+DROP TABLE IF EXISTS "api_token"
+
+--bun:split
+
+DROP TABLE IF EXISTS "status_tag"
+
+--bun:split
+
+DROP TABLE IF EXISTS "tag"
+
+--bun:split
+
+DROP TABLE IF EXISTS "media_attachment"
+
+--bun:split
+
+DROP TABLE IF EXISTS "session"
+
+--bun:split
+
+DROP TABLE IF EXISTS "credential"
+
+--bun:split
+
+DROP TABLE IF EXISTS "sync_state"
+
+--bun:split
+
+DROP TABLE IF EXISTS "status"
+
+--bun:split
+
+DROP TABLE IF EXISTS "visibility"
+
+--bun:split
+
+DROP TABLE IF EXISTS "account"
+
+--bun:split
+
+DROP TABLE IF EXISTS "app"
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS "sync_job" (
+  "id" VARCHAR(255) NOT NULL,
+  "account_id" VARCHAR(255),
+  "host" VARCHAR(255),
+  "state" VARCHAR(255),
+  "pages" BIGINT,
+  "status_count" BIGINT,
+  "oldest_id" VARCHAR(255),
+  "error" VARCHAR(1000),
+  "created_at" DATETIME,
+  "updated_at" DATETIME,
+  "finished_at" DATETIME,
+  PRIMARY KEY ("id"),
+  FOREIGN KEY ("account_id", "host") REFERENCES "account" ("id", "host") ON DELETE CASCADE
+)
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "sync_job_state" ON "sync_job" ("state")
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "sync_job_account" ON "sync_job" ("account_id", "host", "created_at")
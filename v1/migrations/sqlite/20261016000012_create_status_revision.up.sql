@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS "status_revision" (
+  "status_id" VARCHAR(255) NOT NULL,
+  "host" VARCHAR(255) NOT NULL,
+  "text" VARCHAR(10000),
+  "content" TEXT,
+  "spoiler_text" VARCHAR(1000),
+  "sensitive" BOOLEAN,
+  "poll" TEXT,
+  "edited_at" DATETIME,
+  "raw" TEXT,
+  "replaced_at" DATETIME,
+  PRIMARY KEY ("status_id", "host", "replaced_at"),
+  FOREIGN KEY ("status_id", "host") REFERENCES "status" ("id", "host") ON DELETE CASCADE
+)
@@ -0,0 +1,17 @@
+ALTER TABLE "sync_job" DROP COLUMN "deleted_count"
+
+--bun:split
+
+ALTER TABLE "sync_job" DROP COLUMN "kind"
+
+--bun:split
+
+ALTER TABLE "account" DROP COLUMN "hide_deleted"
+
+--bun:split
+
+DROP INDEX IF EXISTS "status_deleted_at"
+
+--bun:split
+
+ALTER TABLE "status" DROP COLUMN "deleted_at"
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "collection_state"
+
+--bun:split
+
+DROP TABLE IF EXISTS "collection_item"
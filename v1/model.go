@@ -1,6 +1,9 @@
 package activitypublog
 
 import (
+	"encoding/json"
+	"fmt"
+	"html/template"
 	"time"
 
 	"github.com/uptrace/bun"
@@ -27,11 +30,43 @@ type Account struct {
 	ShowUnlisted  bool
 	ShowPrivate   bool
 	ShowDirect    bool
+	// インスタンスで削除された投稿を公開ページとフィードに出さない
+	HideDeleted bool `bun:",default:false"`
+	// ブーストを公開ページとフィードに出す。他人の投稿を載せることになるので初期値は出さない
+	ShowReblogs bool `bun:",default:false"`
+}
+
+// 他人に公開するときに見せてよい公開範囲
+func (a Account) PublicVisibilities() []string {
+	var visibilities []string = []string{"public"}
+	if a.ShowUnlisted {
+		visibilities = append(visibilities, "unlisted")
+	}
+	if a.ShowPrivate {
+		visibilities = append(visibilities, "private")
+	}
+	if a.ShowDirect {
+		visibilities = append(visibilities, "direct")
+	}
+	return visibilities
 }
 
 type Tag struct {
-	Name string
-	Url  string
+	bun.BaseModel `bun:"table:tag"`
+	Name          string `bun:",pk"`
+	Url           string `bun:"-"`
+}
+
+type StatusTag struct {
+	bun.BaseModel `bun:"table:status_tag"`
+	StatusId      string `bun:",pk"`
+	Host          string `bun:",pk"`
+	TagName       string `bun:",pk"`
+}
+
+type TagCount struct {
+	Name  string
+	Count int
 }
 
 type Status struct {
@@ -41,8 +76,282 @@ type Status struct {
 	AccountId     string
 	Account       Account `bun:"-"`
 	Text          string  `bun:"type:VARCHAR(10000)"`
+	Content       string  `bun:"type:TEXT"`
+	SpoilerText   string  `bun:"type:VARCHAR(1000)"`
+	Sensitive     bool
+	Language      string
+	InReplyToId   string
+	ReblogId      string
 	Url           string
 	CreatedAt     time.Time
-	Tags          []Tag `bun:"-"`
-	Visibility    string
+	EditedAt      time.Time `bun:",nullzero"`
+	// インスタンスで削除されているのに気づいた時刻。投稿は消さずに残す
+	DeletedAt          time.Time `bun:",nullzero"`
+	ApplicationName    string
+	ApplicationWebsite string          `bun:"type:VARCHAR(1000)"`
+	Poll               json.RawMessage `bun:"type:json"`
+	RepliesCount       int
+	ReblogsCount       int
+	FavouritesCount    int
+	Tags               []Tag             `bun:"-"`
+	MediaAttachments   []MediaAttachment `bun:"-"`
+	// ブーストなら元の投稿の写し。そうでなければnil
+	Reblog *Reblog `bun:"-"`
+	// コレクションとして表示するときの、お気に入りやブックマークにした時刻
+	AddedAt time.Time `bun:"-"`
+	// 検索結果として表示するときの、検索語をハイライトした抜粋
+	Snippet    template.HTML `bun:"-"`
+	Visibility string
+	// APIから返ってきたままのJSON。あとから別の情報を取り出せるように残しておく
+	Raw json.RawMessage `bun:"type:json"`
+	// どこから取り込んだか。空ならStatusSourceApi
+	// rawを保存する前に取り込んだ投稿はimportになっていて、次にAPIから返ってきたときにapiになる
+	Source string
+}
+
+// Status.Source
+const (
+	StatusSourceApi = "api"
+	// アーカイブのoutboxから取り込んだ。インスタンスにはもうないかもしれないので、削除されたか調べない
+	StatusSourceImport = "import"
+	// 他の人(自分かもしれない)のお気に入りやブックマークとして取り込んだ
+	// 投稿者の投稿としては取り込んでいないので、投稿者の投稿一覧、カーソル、公開ページには出さない
+	StatusSourceCollection = "collection"
+)
+
+// 取り込み直したときに、順位が上のsourceになる
+var statusSourceRank = map[string]int{StatusSourceCollection: 0, StatusSourceImport: 1, StatusSourceApi: 2}
+
+// ブーストした時点の元の投稿の写し。元の投稿が消されてもアーカイブに残るように、本文と投稿者を取っておく
+// 添付メディアはブーストした投稿のものとして保存する
+type Reblog struct {
+	bun.BaseModel      `bun:"table:reblog"`
+	StatusId           string `bun:",pk"`
+	Host               string `bun:",pk"`
+	Url                string `bun:"type:VARCHAR(1000)"`
+	AccountAcct        string
+	AccountDisplayName string `bun:"type:VARCHAR(1000)"`
+	AccountUrl         string `bun:"type:VARCHAR(1000)"`
+	AccountAvatar      string `bun:"type:VARCHAR(1000)"`
+	Text               string `bun:"type:VARCHAR(10000)"`
+	Content            string `bun:"type:TEXT"`
+	SpoilerText        string `bun:"type:VARCHAR(1000)"`
+	Sensitive          bool
+	CreatedAt          time.Time
+	MediaAttachments   []MediaAttachment `bun:"-"`
+}
+
+// 編集される前の版。今の版はstatusにある
+type StatusRevision struct {
+	bun.BaseModel `bun:"table:status_revision"`
+	StatusId      string `bun:",pk"`
+	Host          string `bun:",pk"`
+	Text          string `bun:"type:VARCHAR(10000)"`
+	Content       string `bun:"type:TEXT"`
+	SpoilerText   string `bun:"type:VARCHAR(1000)"`
+	Sensitive     bool
+	Poll          json.RawMessage `bun:"type:json"`
+	// この版が書かれた時刻。最初の版ならゼロ
+	EditedAt time.Time       `bun:",nullzero"`
+	Raw      json.RawMessage `bun:"type:json"`
+	// 次の版に編集された時刻
+	ReplacedAt time.Time `bun:",pk"`
+}
+
+// 投稿を保存したときに、それぞれがどうなったかの数
+type UpsertResult struct {
+	Inserted int
+	// 編集されていたか、削除済みにしていた投稿がまたインスタンスから返ってきたので書き換えた
+	Updated   int
+	Unchanged int
+}
+
+func (r UpsertResult) String() string {
+	return fmt.Sprintf("%d inserted, %d updated, %d unchanged", r.Inserted, r.Updated, r.Unchanged)
+}
+
+func (r *UpsertResult) Add(other UpsertResult) {
+	r.Inserted += other.Inserted
+	r.Updated += other.Updated
+	r.Unchanged += other.Unchanged
+}
+
+type SyncState struct {
+	bun.BaseModel `bun:"table:sync_state"`
+	AccountId     string    `bun:",pk"`
+	Host          string    `bun:",pk"`
+	LastRunAt     time.Time `bun:",nullzero"`
+	NextRunAt     time.Time
+	LastError     string `bun:"type:VARCHAR(1000)"`
+}
+
+// 自分の投稿とは別に取り込む、お気に入りとブックマークした投稿の集まり
+const (
+	CollectionFavourites = "favourites"
+	CollectionBookmarks  = "bookmarks"
+)
+
+var Collections = []string{CollectionFavourites, CollectionBookmarks}
+
+func IsCollection(name string) bool {
+	for _, collection := range Collections {
+		if collection == name {
+			return true
+		}
+	}
+	return false
+}
+
+// コレクションに入っている投稿。投稿そのものは投稿者のものとしてstatusに保存する
+type CollectionItem struct {
+	bun.BaseModel `bun:"table:collection_item"`
+	AccountId     string `bun:",pk"`
+	Host          string `bun:",pk"`
+	Collection    string `bun:",pk"`
+	StatusId      string `bun:",pk"`
+	// お気に入りやブックマークにした時刻。APIは返さないので新しい方の同期で見つけた時刻にする
+	// 遡って取り込んだものはわからないのでゼロ
+	AddedAt time.Time `bun:",nullzero"`
+}
+
+// コレクションをどこまで遡ったか
+// お気に入りとブックマークのページのカーソルは投稿のIDではないので、LinkヘッダーのURLのmax_idを覚えておく
+type CollectionState struct {
+	bun.BaseModel `bun:"table:collection_state"`
+	AccountId     string `bun:",pk"`
+	Host          string `bun:",pk"`
+	Collection    string `bun:",pk"`
+	MaxId         string
+	AllFetched    bool
+}
+
+type Credential struct {
+	bun.BaseModel  `bun:"table:credential"`
+	AccountId      string `bun:",pk"`
+	Host           string `bun:",pk"`
+	EncryptedToken string `bun:"type:VARCHAR(1000)"`
+	Scope          string
+	CreatedAt      time.Time
+}
+
+// ログイン時にverify_credentialsで得たアカウント情報をキャッシュしておき、
+// リクエストのたびにインスタンスへ問い合わせなくて済むようにする
+type Session struct {
+	bun.BaseModel `bun:"table:session"`
+	Id            string `bun:",pk"`
+	AccountId     string
+	Host          string
+	UserName      string
+	Acct          string
+	DisplayName   string
+	Avatar        string `bun:"type:VARCHAR(1000)"`
+	Url           string `bun:"type:VARCHAR(1000)"`
+	CsrfToken     string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// セッションにキャッシュしている表示用の情報をアカウントに載せる
+func (s Session) FillAccount(account Account) Account {
+	account.Acct = s.Acct
+	account.DisplayName = s.DisplayName
+	account.Avatar = s.Avatar
+	account.Url = s.Url
+	return account
+}
+
+// BlobHashが空のものはまだダウンロードできていない
+type MediaAttachment struct {
+	bun.BaseModel      `bun:"table:media_attachment"`
+	Id                 string `bun:",pk"`
+	Host               string `bun:",pk"`
+	StatusId           string
+	Type               string
+	RemoteUrl          string `bun:"type:VARCHAR(2000)"`
+	PreviewRemoteUrl   string `bun:"type:VARCHAR(2000)"`
+	Description        string `bun:"type:TEXT"`
+	Blurhash           string
+	BlobHash           string
+	ContentType        string
+	PreviewBlobHash    string
+	PreviewContentType string
+	FetchAttempts      int
+	FetchError         string `bun:"type:VARCHAR(1000)"`
+}
+
+// 個人用APIトークン。トークンそのものは保存せずsha256だけを持つ
+type ApiToken struct {
+	bun.BaseModel `bun:"table:api_token"`
+	Id            string `bun:",pk"`
+	AccountId     string
+	Host          string
+	Name          string
+	TokenHash     string `bun:",unique"`
+	CreatedAt     time.Time
+	LastUsedAt    time.Time `bun:",nullzero"`
+}
+
+const (
+	ExportQueued  = "queued"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// アーカイブをZIPにまとめるジョブ。できたファイルはEXPORT_DIRに置く
+type ExportJob struct {
+	bun.BaseModel `bun:"table:export_job"`
+	Id            string `bun:",pk"`
+	AccountId     string
+	Host          string
+	State         string
+	StatusCount   int
+	Size          int64
+	Error         string `bun:"type:VARCHAR(1000)"`
+	CreatedAt     time.Time
+	FinishedAt    time.Time `bun:",nullzero"`
+}
+
+const (
+	SyncJobQueued    = "queued"
+	SyncJobRunning   = "running"
+	SyncJobDone      = "done"
+	SyncJobFailed    = "failed"
+	SyncJobCancelled = "cancelled"
+)
+
+// SyncJob.Kind
+const (
+	// 古い投稿を遡って取り込む
+	SyncJobBackfill = "backfill"
+	// インスタンスの投稿を最初から最後までたどって、削除された投稿を見つける
+	SyncJobReconcile = "reconcile"
+	// お気に入りとブックマークを遡って取り込む。コレクションの名前と同じにしておく
+	SyncJobFavourites = CollectionFavourites
+	SyncJobBookmarks  = CollectionBookmarks
+)
+
+// インスタンスの投稿をページをたどって取り込むジョブ。種類にかかわらず、1アカウントにつき動いているものは1つだけ
+// 1ページ取り込むごとに進み具合を保存する
+type SyncJob struct {
+	bun.BaseModel `bun:"table:sync_job"`
+	Id            string `bun:",pk"`
+	AccountId     string
+	Host          string
+	Kind          string
+	State         string
+	Pages         int
+	StatusCount   int
+	// ここまで遡った
+	OldestId string
+	// reconcileで削除済みにした投稿の数
+	DeletedCount int
+	Error        string `bun:"type:VARCHAR(1000)"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	FinishedAt   time.Time `bun:",nullzero"`
+}
+
+func (j SyncJob) Active() bool {
+	return j.State == SyncJobQueued || j.State == SyncJobRunning
 }
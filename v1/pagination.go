@@ -0,0 +1,143 @@
+package activitypublog
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+const defaultPageLimit = 40
+const maxPageLimit = 200
+
+// Mastodon APIと同じ意味のカーソル
+// max_idを指定するとそれより古い投稿を、min_idを指定するとそのすぐ後に続く新しい投稿を返す
+type PageParams struct {
+	MaxId string
+	MinId string
+	Limit int
+}
+
+func ParsePageParams(values url.Values) PageParams {
+	page := PageParams{
+		MaxId: values.Get("max_id"),
+		MinId: values.Get("min_id"),
+		Limit: defaultPageLimit,
+	}
+	if limit, err := strconv.Atoi(values.Get("limit")); err == nil && limit > 0 {
+		page.Limit = limit
+	}
+	if page.Limit > maxPageLimit {
+		page.Limit = maxPageLimit
+	}
+	return page
+}
+
+// 常に新しい順に並んでいる
+// NextMaxIdは次の(より古い)ページ、PrevMinIdは前の(より新しい)ページのカーソルで、なければ空
+type Page struct {
+	Statuses  []Status
+	NextMaxId string
+	PrevMinId string
+}
+
+// 続きがあるかを知るためにlimitより1件多く取得する
+func applyPageParams(q *bun.SelectQuery, page PageParams, idColumn string) *bun.SelectQuery {
+	if page.MaxId != "" {
+		q = whereStatusId(q, idColumn, "<", page.MaxId)
+	}
+	if page.MinId != "" {
+		q = orderByStatusId(whereStatusId(q, idColumn, ">", page.MinId), idColumn, "ASC")
+	} else {
+		q = orderByStatusId(q, idColumn, "DESC")
+	}
+	return q.Limit(page.Limit + 1)
+}
+
+// MastodonのIDは数字の文字列で、古いインスタンスでは桁数がそろっていない
+func compareStatusIds(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// DBでもcompareStatusIdsと同じように、文字列のままではなく桁数から比べて並べる
+func orderByStatusId(q *bun.SelectQuery, idColumn string, direction string) *bun.SelectQuery {
+	return q.OrderExpr("LENGTH(?) "+direction+", ? "+direction, bun.Ident(idColumn), bun.Ident(idColumn))
+}
+
+// opは<、<=、>、>=のどれか。idColumnがidより古いもの、新しいものに絞る
+func whereStatusId(q *bun.SelectQuery, idColumn string, op string, id string) *bun.SelectQuery {
+	// 桁数が違えば等しくならないので、桁数は=を付けずに比べる
+	return q.Where("(LENGTH(?) "+op[:1]+" ? OR (LENGTH(?) = ? AND ? "+op+" ?))",
+		bun.Ident(idColumn), len(id), bun.Ident(idColumn), len(id), bun.Ident(idColumn), id)
+}
+
+// applyPageParamsで取得した結果からPageを作る
+func newPage(statuses []Status, page PageParams) Page {
+	hasMore := len(statuses) > page.Limit
+	if hasMore {
+		statuses = statuses[:page.Limit]
+	}
+	if page.MinId != "" {
+		for i, j := 0, len(statuses)-1; i < j; i, j = i+1, j-1 {
+			statuses[i], statuses[j] = statuses[j], statuses[i]
+		}
+	}
+	p := Page{Statuses: statuses}
+	if len(statuses) == 0 {
+		// 範囲の外に出てしまったときは、来た方向に戻れるようにだけしておく
+		if page.MaxId != "" {
+			p.PrevMinId = page.MaxId
+		}
+		if page.MinId != "" {
+			p.NextMaxId = page.MinId
+		}
+		return p
+	}
+	newest := statuses[0].Id
+	oldest := statuses[len(statuses)-1].Id
+	if page.MinId != "" {
+		p.NextMaxId = oldest
+		if hasMore {
+			p.PrevMinId = newest
+		}
+	} else {
+		if hasMore {
+			p.NextMaxId = oldest
+		}
+		if page.MaxId != "" {
+			p.PrevMinId = newest
+		}
+	}
+	return p
+}
+
+func selectPage(ctx context.Context, q *bun.SelectQuery, statuses *[]Status, page PageParams, idColumn string) (Page, error) {
+	if err := applyPageParams(q, page, idColumn).Scan(ctx); err != nil {
+		return Page{}, err
+	}
+	p := newPage(*statuses, page)
+	return p, nil
+}
+
+// 今のURLのクエリを引き継いで、前後のページへのURLを作る
+func pageLinks(u *url.URL, page Page) (string, string) {
+	link := func(key string, id string) string {
+		if id == "" {
+			return ""
+		}
+		q := u.Query()
+		q.Del("max_id")
+		q.Del("min_id")
+		q.Set(key, id)
+		return u.Path + "?" + q.Encode()
+	}
+	return link("min_id", page.PrevMinId), link("max_id", page.NextMaxId)
+}
@@ -0,0 +1,82 @@
+package activitypublog
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParsePageParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PageParams
+	}{
+		{"", PageParams{Limit: defaultPageLimit}},
+		{"max_id=10&limit=5", PageParams{MaxId: "10", Limit: 5}},
+		{"min_id=10&limit=0", PageParams{MinId: "10", Limit: defaultPageLimit}},
+		{"limit=abc", PageParams{Limit: defaultPageLimit}},
+		{"limit=1000", PageParams{Limit: maxPageLimit}},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.in)
+		if got := ParsePageParams(values); got != tt.want {
+			t.Errorf("ParsePageParams(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	statuses := func(ids ...string) []Status {
+		var s []Status
+		for _, id := range ids {
+			s = append(s, Status{Id: id})
+		}
+		return s
+	}
+	tests := []struct {
+		name     string
+		statuses []Status
+		page     PageParams
+		want     Page
+	}{
+		{"first page", statuses("5", "4", "3"), PageParams{Limit: 2}, Page{Statuses: statuses("5", "4"), NextMaxId: "4"}},
+		{"last page", statuses("2", "1"), PageParams{MaxId: "3", Limit: 2}, Page{Statuses: statuses("2", "1"), PrevMinId: "2"}},
+		{"min_id", statuses("3", "4", "5"), PageParams{MinId: "2", Limit: 2}, Page{Statuses: statuses("4", "3"), NextMaxId: "3", PrevMinId: "4"}},
+		{"past the end", nil, PageParams{MaxId: "1", Limit: 2}, Page{PrevMinId: "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPage(tt.statuses, tt.page); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newPage = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	u, _ := url.Parse("/tags/go?max_id=9&q=a")
+	prev, next := pageLinks(u, Page{PrevMinId: "8", NextMaxId: "5"})
+	if prev != "/tags/go?min_id=8&q=a" || next != "/tags/go?max_id=5&q=a" {
+		t.Errorf("pageLinks = %q, %q", prev, next)
+	}
+}
+
+func TestCompareStatusIds(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1", "1", 0},
+		{"1", "2", -1},
+		{"2", "1", 1},
+		{"9", "10", -1},
+		{"100", "99", 1},
+		{"109876543210987654", "110000000000000000", -1},
+		{"", "1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareStatusIds(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareStatusIds(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package activitypublog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/chao7150/activitypublog/mastodon"
+	"github.com/uptrace/bun"
+)
+
+const reblogSnapshotBatchSize = 500
+
+// 写しを保存するようになる前に取り込んだブーストに、保存してあるRawから写しと添付を作る
+// Rawに元の投稿が入っていなければ空の写しを入れて、次からは探さない
+func (s *Server) snapshotStoredReblogs(ctx context.Context) error {
+	for {
+		statuses, err := dSelectReblogsWithoutSnapshot(ctx, s.db, reblogSnapshotBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			return nil
+		}
+		var converted []Status
+		var attachments []MediaAttachment
+		for _, status := range statuses {
+			var v mastodon.Status
+			if err := json.Unmarshal(status.Raw, &v); err != nil || v.Reblog == nil {
+				converted = append(converted, Status{Reblog: &Reblog{StatusId: status.Id, Host: status.Host}})
+				continue
+			}
+			c := hConvertStatus(v, status.Host, status.AccountId)
+			// Rawのidと行のidは同じはずだが、写しは行の方に付ける
+			c.Reblog.StatusId = status.Id
+			for i := range c.MediaAttachments {
+				c.MediaAttachments[i].StatusId = status.Id
+			}
+			converted = append(converted, c)
+			attachments = append(attachments, c.MediaAttachments...)
+		}
+		err = s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := insertMediaAttachments(ctx, tx, attachments); err != nil {
+				return err
+			}
+			return insertReblogs(ctx, tx, converted)
+		})
+		if err != nil {
+			return fmt.Errorf("snapshotStoredReblogs: %v", err)
+		}
+		fmt.Printf("snapshotted %d reblogs\n", len(statuses))
+	}
+}
@@ -1,18 +1,54 @@
 package activitypublog
 
 import (
+	"html/template"
 	"io"
-	"text/template"
+	"sort"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+// 値はhtml/templateが文脈に合わせてエスケープする。URLパラメーターやインスタンスから来た値をそのまま渡してよい
 type Template struct {
 	templates *template.Template
+	location  *time.Location
+}
+
+// csrfFieldはRenderのたびにリクエストのトークンを返すものに差し替える。トークンはフォームを描くときに初めて調べる
+// 日時はDBから読んだままなので、表示するときにlocalで設定のタイムゾーンにする
+// インスタンスから来たHTMLはsanitizeを通してから埋め込み、他人の書いたURLはhttpUrlでhttpとhttpsに限る
+func templateFuncs(csrfToken func() (string, error), location *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func() (template.HTML, error) {
+			token, err := csrfToken()
+			if err != nil {
+				return "", err
+			}
+			return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `">`), nil
+		},
+		"local": func(t time.Time) time.Time {
+			return t.In(location)
+		},
+		"sanitize": sanitizeContent,
+		"httpUrl":  httpUrl,
+	}
+}
+
+func NewTemplate(pattern string, location *time.Location) *Template {
+	return &Template{
+		templates: template.Must(template.New("").Funcs(templateFuncs(nil, location)).ParseGlob(pattern)),
+		location:  location,
+	}
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.templates.ExecuteTemplate(w, name, data)
+	templates, err := t.templates.Clone()
+	if err != nil {
+		return err
+	}
+	csrfToken := func() (string, error) { return csrfTokenOf(c) }
+	return templates.Funcs(templateFuncs(csrfToken, t.location)).ExecuteTemplate(w, name, data)
 }
 
 type TopProps struct {
@@ -21,10 +57,70 @@ type TopProps struct {
 	AllFetched          bool
 	NoMoreNewerStatuses bool
 	Public              bool
+	SyncState           SyncState
+	SyncQueued          bool
+	TagCloud            []TagCloudEntry
+	Query               string
+	PrevUrl             string
+	NextUrl             string
+	ApiTokens           []ApiToken
+	Export              ExportJob
+	Import              *ImportResult
+	SyncJob             SyncJob
+	// 表示しているタブ。空なら自分の投稿
+	Collection      string
+	CollectionState CollectionState
+}
+
+type ApiTokenProps struct {
+	ApiToken ApiToken
+	Token    string
 }
 
 type UsersProps struct {
 	Host     string
 	UserName string
 	Statuses []Status
+	Tag      string
+	TagCloud []TagCloudEntry
+	PrevUrl  string
+	NextUrl  string
+}
+
+type TagProps struct {
+	Tag      string
+	Statuses []Status
+	PrevUrl  string
+	NextUrl  string
+}
+
+const tagCloudSize = 50
+
+// Levelは1から5で、多く使われているタグほど大きい
+type TagCloudEntry struct {
+	Name  string
+	Count int
+	Level int
+}
+
+// 使用回数の多い順に並んだcountsから上位limit件を取り出し、名前順に並べる
+func NewTagCloud(counts []TagCount, limit int) []TagCloudEntry {
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	max := counts[0].Count
+	min := counts[len(counts)-1].Count
+	entries := make([]TagCloudEntry, 0, len(counts))
+	for _, count := range counts {
+		level := 1
+		if max > min {
+			level = 1 + (count.Count-min)*4/(max-min)
+		}
+		entries = append(entries, TagCloudEntry{Name: count.Name, Count: count.Count, Level: level})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
 }
@@ -0,0 +1,67 @@
+package activitypublog
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRenderEscapesValues(t *testing.T) {
+	renderer := NewTemplate("public/views/*.html", time.UTC)
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	var b bytes.Buffer
+	err := renderer.Render(&b, "tag", TagProps{
+		Tag: `<script>alert(1)</script>`,
+		Statuses: []Status{
+			{Text: `<img src=x onerror=alert(2)>`},
+			{Content: `<p>ok<script>alert(3)</script></p>`, SpoilerText: `<b>cw</b>`},
+		},
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := b.String()
+	for _, unsafe := range []string{"<script>", "<img", "<b>cw"} {
+		if strings.Contains(html, unsafe) {
+			t.Errorf("rendered page contains %q:\n%s", unsafe, html)
+		}
+	}
+	for _, escaped := range []string{"&lt;script&gt;alert(1)", "&lt;img src=x", "<p>ok</p>"} {
+		if !strings.Contains(html, escaped) {
+			t.Errorf("rendered page does not contain %q:\n%s", escaped, html)
+		}
+	}
+}
+
+func TestRenderSearchResults(t *testing.T) {
+	renderer := NewTemplate("public/views/*.html", time.UTC)
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/?q=tower", nil), httptest.NewRecorder())
+	query := `tower "><script>`
+	text := `Tokyo tower & <i>night</i>`
+	var b bytes.Buffer
+	err := renderer.Render(&b, "top", TopProps{
+		Query:    query,
+		Statuses: []Status{{Text: text, Snippet: highlightSnippet(text, ParseSearchQuery(query, time.UTC).Terms())}},
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := b.String()
+	for _, want := range []string{
+		`Tokyo <mark>tower</mark> &amp; &lt;i&gt;night&lt;/i&gt;`,
+		`value="tower &#34;&gt;&lt;script&gt;"`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("rendered page does not contain %q:\n%s", want, html)
+		}
+	}
+	for _, unwanted := range []string{"&lt;mark&gt;", "&amp;amp;", "<script>"} {
+		if strings.Contains(html, unwanted) {
+			t.Errorf("rendered page contains %q:\n%s", unwanted, html)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package activitypublog
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+// 検索クエリを解析したもの
+// Groupsの各要素はどれか1つに一致すればよい語の集まりで、すべてのグループに一致した投稿を返す
+// 語は空白を含んでいればフレーズとして扱う
+type SearchQuery struct {
+	Groups       [][]string
+	Not          []string
+	From         string
+	Before       time.Time
+	After        time.Time
+	Visibilities []string
+	HasMedia     bool
+	// インスタンスで削除された投稿だけ
+	Deleted bool
+	// 空なら自分の投稿から、favouritesかbookmarksならそのコレクションから探す
+	Collection string
+}
+
+// Collectionはどこから探すかなので見ない
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Groups) == 0 && len(q.Not) == 0 && q.From == "" && q.Before.IsZero() && q.After.IsZero() && len(q.Visibilities) == 0 && !q.HasMedia && !q.Deleted
+}
+
+// ハイライトに使う語
+func (q SearchQuery) Terms() []string {
+	var terms []string
+	for _, group := range q.Groups {
+		terms = append(terms, group...)
+	}
+	return terms
+}
+
+// 全文検索の実装
+// MySQLのFULLTEXTインデックスを使うものの他に、Bleveなどの組み込みインデックスに差し替えられるようにしておく
+type Searcher interface {
+	// インデックスの準備をする。起動時に呼ぶ
+	Init(ctx context.Context) error
+	// 取り込んだ投稿をインデックスに入れる。DBのインデックスを使う実装では何もしない
+	Index(ctx context.Context, statuses []Status) error
+	Search(ctx context.Context, accountId string, host string, q SearchQuery, page PageParams) (Page, error)
+}
+
+// 検索語を解析する
+//
+//	"東京 タワー"     フレーズ
+//	a b            aとbの両方を含む (ANDと書いてもよい)
+//	a OR b         aかbを含む
+//	-a, NOT a      aを含まない
+//	from:user      投稿者
+//	before:2006-01-02, after:2006-01-02
+//	visibility:public
+//	has:media
+//	is:deleted
+//	in:favourites, in:bookmarks
+func ParseSearchQuery(s string, location *time.Location) SearchQuery {
+	var q SearchQuery
+	tokens := tokenizeSearchQuery(s)
+	joinNext := false
+	negateNext := false
+	for _, token := range tokens {
+		if !token.quoted {
+			switch token.value {
+			case "OR":
+				joinNext = len(q.Groups) > 0
+				continue
+			case "AND":
+				continue
+			case "NOT":
+				negateNext = true
+				continue
+			}
+			if strings.HasPrefix(token.value, "-") && len(token.value) > 1 {
+				q.Not = append(q.Not, token.value[1:])
+				continue
+			}
+			if key, value, ok := strings.Cut(token.value, ":"); ok && value != "" {
+				handled := true
+				switch key {
+				case "from":
+					q.From = strings.TrimPrefix(value, "@")
+				case "before":
+					if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+						q.Before = t
+					}
+				case "after":
+					if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+						q.After = t.AddDate(0, 0, 1)
+					}
+				case "visibility":
+					q.Visibilities = append(q.Visibilities, value)
+				case "has":
+					q.HasMedia = q.HasMedia || value == "media"
+				case "is":
+					q.Deleted = q.Deleted || value == "deleted"
+				case "in":
+					if IsCollection(value) {
+						q.Collection = value
+					}
+				default:
+					handled = false
+				}
+				if handled {
+					continue
+				}
+			}
+		}
+		if negateNext {
+			q.Not = append(q.Not, token.value)
+			negateNext = false
+			continue
+		}
+		if joinNext {
+			last := len(q.Groups) - 1
+			q.Groups[last] = append(q.Groups[last], token.value)
+			joinNext = false
+			continue
+		}
+		q.Groups = append(q.Groups, []string{token.value})
+	}
+	return q
+}
+
+type searchToken struct {
+	value  string
+	quoted bool
+}
+
+func tokenizeSearchQuery(s string) []searchToken {
+	var tokens []searchToken
+	var current strings.Builder
+	inQuote := false
+	flush := func(quoted bool) {
+		if current.Len() > 0 {
+			tokens = append(tokens, searchToken{value: current.String(), quoted: quoted})
+			current.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case r == '"':
+			flush(inQuote)
+			inQuote = !inQuote
+		case !inQuote && (r == ' ' || r == '\t' || r == '　'):
+			flush(false)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush(inQuote)
+	return tokens
+}
+
+// ngramパーサーの既定のトークン長。これより短い語はインデックスで引けないのでLIKEで探す
+const ngramTokenSize = 2
+
+type MySQLSearcher struct {
+	db *bun.DB
+}
+
+func NewMySQLSearcher(db *bun.DB) *MySQLSearcher {
+	return &MySQLSearcher{db: db}
+}
+
+// FULLTEXTインデックスはマイグレーションで作る
+func (s *MySQLSearcher) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *MySQLSearcher) Index(ctx context.Context, statuses []Status) error {
+	return nil
+}
+
+func (s *MySQLSearcher) Search(ctx context.Context, accountId string, host string, q SearchQuery, page PageParams) (Page, error) {
+	var statuses []Status
+	sel := s.db.NewSelect().
+		Model(&statuses).
+		ExcludeColumn("raw")
+	sel = whereSearchScope(sel, accountId, host, q.Collection)
+
+	var against []string
+	for _, group := range q.Groups {
+		if allLongTerms(group) {
+			var quoted []string
+			for _, term := range group {
+				quoted = append(quoted, booleanModePhrase(term))
+			}
+			against = append(against, "+("+strings.Join(quoted, " ")+")")
+			continue
+		}
+		group := group
+		sel = sel.WhereGroup(" AND ", func(sq *bun.SelectQuery) *bun.SelectQuery {
+			for _, term := range group {
+				sq = sq.WhereOr("status.text LIKE ?", likePattern(term))
+			}
+			return sq
+		})
+	}
+	for _, term := range q.Not {
+		// 否定だけの式はMATCHが何も返さないので、肯定の語がなければLIKEで除外する
+		if len(against) > 0 && utf8.RuneCountInString(term) >= ngramTokenSize {
+			against = append(against, "-"+booleanModePhrase(term))
+			continue
+		}
+		sel = sel.Where("status.text NOT LIKE ?", likePattern(term))
+	}
+	if len(against) > 0 {
+		sel = sel.Where("MATCH (status.text, status.spoiler_text) AGAINST (? IN BOOLEAN MODE)", strings.Join(against, " "))
+	}
+	if q.From != "" {
+		sel = sel.Where("JSON_UNQUOTE(JSON_EXTRACT(status.raw, '$.account.acct')) IN (?, ?)", q.From, strings.SplitN(q.From, "@", 2)[0])
+	}
+	if !q.Before.IsZero() {
+		sel = sel.Where("status.created_at < ?", q.Before.UTC())
+	}
+	if !q.After.IsZero() {
+		sel = sel.Where("status.created_at >= ?", q.After.UTC())
+	}
+	if len(q.Visibilities) > 0 {
+		sel = sel.Where("status.visibility IN (?)", bun.In(q.Visibilities))
+	}
+	if q.HasMedia {
+		sel = sel.Where("EXISTS (SELECT 1 FROM media_attachment WHERE media_attachment.status_id = status.id AND media_attachment.host = status.host)")
+	}
+	if q.Deleted {
+		sel = sel.Where("status.deleted_at IS NOT NULL")
+	}
+	p, err := selectPage(ctx, sel, &statuses, page, "status.id")
+	if err != nil {
+		return p, fmt.Errorf("MySQLSearcher.Search: %v", err)
+	}
+	return p, nil
+}
+
+// DBの全文検索インデックスがないときに、LIKEで探す
+// PostgreSQLとSQLiteで使う。件数が多いと遅いが、個人のアーカイブなら足りる
+type LikeSearcher struct {
+	db *bun.DB
+}
+
+func NewLikeSearcher(db *bun.DB) *LikeSearcher {
+	return &LikeSearcher{db: db}
+}
+
+func (s *LikeSearcher) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *LikeSearcher) Index(ctx context.Context, statuses []Status) error {
+	return nil
+}
+
+func (s *LikeSearcher) Search(ctx context.Context, accountId string, host string, q SearchQuery, page PageParams) (Page, error) {
+	var statuses []Status
+	sel := s.db.NewSelect().
+		Model(&statuses).
+		ExcludeColumn("raw")
+	sel = whereSearchScope(sel, accountId, host, q.Collection)
+
+	// 大文字小文字を区別しないのはMySQLの照合順序に合わせている
+	const matches = `(LOWER(COALESCE(status.text, '')) LIKE LOWER(?) ESCAPE '\' OR LOWER(COALESCE(status.spoiler_text, '')) LIKE LOWER(?) ESCAPE '\')`
+	for _, group := range q.Groups {
+		group := group
+		sel = sel.WhereGroup(" AND ", func(sq *bun.SelectQuery) *bun.SelectQuery {
+			for _, term := range group {
+				sq = sq.WhereOr(matches, likePattern(term), likePattern(term))
+			}
+			return sq
+		})
+	}
+	for _, term := range q.Not {
+		sel = sel.Where("NOT "+matches, likePattern(term), likePattern(term))
+	}
+	if q.From != "" {
+		acct := "json_extract(status.raw, '$.account.acct')"
+		if s.db.Dialect().Name() == dialect.PG {
+			acct = "status.raw->'account'->>'acct'"
+		}
+		sel = sel.Where(acct+" IN (?, ?)", q.From, strings.SplitN(q.From, "@", 2)[0])
+	}
+	if !q.Before.IsZero() {
+		sel = sel.Where("status.created_at < ?", q.Before.UTC())
+	}
+	if !q.After.IsZero() {
+		sel = sel.Where("status.created_at >= ?", q.After.UTC())
+	}
+	if len(q.Visibilities) > 0 {
+		sel = sel.Where("status.visibility IN (?)", bun.In(q.Visibilities))
+	}
+	if q.HasMedia {
+		sel = sel.Where("EXISTS (SELECT 1 FROM media_attachment WHERE media_attachment.status_id = status.id AND media_attachment.host = status.host)")
+	}
+	if q.Deleted {
+		sel = sel.Where("status.deleted_at IS NOT NULL")
+	}
+	p, err := selectPage(ctx, sel, &statuses, page, "status.id")
+	if err != nil {
+		return p, fmt.Errorf("LikeSearcher.Search: %v", err)
+	}
+	return p, nil
+}
+
+// 自分の投稿か、コレクションに入っている他人の投稿に絞る
+func whereSearchScope(sel *bun.SelectQuery, accountId string, host string, collection string) *bun.SelectQuery {
+	if collection == "" {
+		return sel.Where("status.account_id = ? AND status.host = ? AND status.source != ?", accountId, host, StatusSourceCollection)
+	}
+	return sel.
+		Where("EXISTS (SELECT 1 FROM collection_item WHERE collection_item.status_id = status.id AND collection_item.host = status.host AND collection_item.account_id = ? AND collection_item.collection = ?)", accountId, collection).
+		Where("status.host = ?", host)
+}
+
+// FULLTEXTインデックスがあるのはMySQLだけ
+func newSearcher(db *bun.DB) Searcher {
+	if db.Dialect().Name() == dialect.MySQL {
+		return NewMySQLSearcher(db)
+	}
+	return NewLikeSearcher(db)
+}
+
+func allLongTerms(terms []string) bool {
+	for _, term := range terms {
+		if utf8.RuneCountInString(term) < ngramTokenSize {
+			return false
+		}
+	}
+	return true
+}
+
+// BOOLEAN MODEの演算子として解釈されないように、語は常にダブルクォートで囲む
+func booleanModePhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, "") + `"`
+}
+
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+const snippetRadius = 60
+
+// 最初に見つかった語の前後を切り出し、検索語を<mark>で囲んだHTMLを作る。本文はエスケープ済みなのでそのまま埋め込める
+func highlightSnippet(text string, terms []string) template.HTML {
+	if len(terms) == 0 {
+		return ""
+	}
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	start := -1
+	for _, term := range terms {
+		if i := indexRunes(lower, []rune(strings.ToLower(term))); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	from := start - snippetRadius
+	if from < 0 {
+		from = 0
+	}
+	to := start + snippetRadius
+	if to > len(runes) {
+		to = len(runes)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	i := from
+	for i < to {
+		matched := 0
+		for _, term := range terms {
+			t := []rune(strings.ToLower(term))
+			if len(t) > 0 && i+len(t) <= len(lower) && string(lower[i:i+len(t)]) == string(t) && len(t) > matched {
+				matched = len(t)
+			}
+		}
+		if matched > 0 {
+			b.WriteString("<mark>" + html.EscapeString(string(runes[i:i+matched])) + "</mark>")
+			i += matched
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		i++
+	}
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+func indexRunes(s []rune, sub []rune) int {
+	if len(sub) == 0 {
+		return -1
+	}
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if string(s[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+	return -1
+}
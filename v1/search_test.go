@@ -0,0 +1,70 @@
+package activitypublog
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	tests := []struct {
+		name string
+		in   string
+		want SearchQuery
+	}{
+		{"empty", "", SearchQuery{}},
+		{"and", "a b AND c", SearchQuery{Groups: [][]string{{"a"}, {"b"}, {"c"}}}},
+		{"or", "a OR b c", SearchQuery{Groups: [][]string{{"a", "b"}, {"c"}}}},
+		{"leading or", "OR a", SearchQuery{Groups: [][]string{{"a"}}}},
+		{"phrase", `"東京 タワー" 夜景`, SearchQuery{Groups: [][]string{{"東京 タワー"}, {"夜景"}}}},
+		{"full-width space", "東京　タワー", SearchQuery{Groups: [][]string{{"東京"}, {"タワー"}}}},
+		{"not", "a -b NOT c", SearchQuery{Groups: [][]string{{"a"}}, Not: []string{"b", "c"}}},
+		{"quoted operator", `"from:alice"`, SearchQuery{Groups: [][]string{{"from:alice"}}}},
+		{"from", "from:@alice", SearchQuery{From: "alice"}},
+		{"dates", "before:2026-01-02 after:2026-01-01", SearchQuery{
+			Before: time.Date(2026, 1, 2, 0, 0, 0, 0, tokyo),
+			After:  time.Date(2026, 1, 2, 0, 0, 0, 0, tokyo),
+		}},
+		{"invalid date", "before:yesterday", SearchQuery{}},
+		{"filters", "visibility:public visibility:unlisted has:media is:deleted", SearchQuery{
+			Visibilities: []string{"public", "unlisted"},
+			HasMedia:     true,
+			Deleted:      true,
+		}},
+		{"collection", "in:bookmarks a", SearchQuery{Groups: [][]string{{"a"}}, Collection: CollectionBookmarks}},
+		{"unknown collection", "in:lists", SearchQuery{}},
+		{"unknown key", "foo:bar", SearchQuery{Groups: [][]string{{"foo:bar"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseSearchQuery(tt.in, tokyo)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSearchQuery(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  template.HTML
+	}{
+		{"no terms", "abc", nil, ""},
+		{"mark", "Tokyo tower at night", []string{"tower"}, "Tokyo <mark>tower</mark> at night"},
+		{"case insensitive", "Tokyo Tower", []string{"tower"}, "Tokyo <mark>Tower</mark>"},
+		{"escape", `<b>a</b> & "b"`, []string{"&"}, "&lt;b&gt;a&lt;/b&gt; <mark>&amp;</mark> &#34;b&#34;"},
+		{"longest match", "東京タワー", []string{"東京", "東京タワー"}, "<mark>東京タワー</mark>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.text, tt.terms); got != tt.want {
+				t.Errorf("highlightSnippet(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,203 +2,474 @@ package activitypublog
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
+	"crypto/subtle"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"text/template"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
+	"github.com/chao7150/activitypublog/mastodon"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/uptrace/bun"
-	"github.com/uptrace/bun/dialect/mysqldialect"
 )
 
-var db *sql.DB
-var bundb *bun.DB
-var ctx = context.Background()
+// インスタンスへのリクエストとメディアのダウンロードに使う
+const defaultHttpTimeout = 5 * time.Minute
 
-type PostOauthTokenResponse struct {
-	AccessToken  string `json:"access_token"`
-	TokenType    string `json:"token_type"`
-	Scope        string `json:"scope"`
-	CreatedAt    int64  `json:"created_at"`
-	RefreshToken string `json:"refresh_token"`
+// 止めるときに処理中のリクエストを待つ時間
+const shutdownTimeout = 30 * time.Second
+
+// アーカイブのWebアプリケーションと、同期・遡り・ストリーミング・エクスポートのワーカー
+// 使うものはすべてフィールドに持つので、他のプログラムに組み込んだり1つのプロセスで複数動かしたりできる
+type Server struct {
+	config     Config
+	store      Store
+	db         *bun.DB
+	httpClient *http.Client
+	// メディアのダウンロードに使う。プライベートなアドレスには接続しない
+	mediaClient *http.Client
+	clock       Clock
+	blobStore   BlobStore
+	searcher    Searcher
+	syncer      *Syncer
+	backfiller  *Backfiller
+	streamer    *Streamer
+	exporter    *Exporter
+	echo        *echo.Echo
+
+	mu sync.Mutex
+	// ホストとトークンごとのクライアント。mastodonClientを参照
+	mastodonClients map[string]*mastodon.Client
 }
 
-func StartServer() {
-	err := godotenv.Load(".env")
+// httpClientとclockはnilなら既定のものを使う
+func NewServer(config Config, store Store, httpClient *http.Client, clock Clock) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("NewServer: %v", err)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultHttpTimeout}
+	}
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	blobStore, err := newBlobStore(config.Media)
 	if err != nil {
-		fmt.Println("failed to load env file")
-		return
+		return nil, fmt.Errorf("NewServer: %v", err)
 	}
+	s := &Server{
+		config:      config,
+		store:       store,
+		db:          store.DB(),
+		httpClient:  httpClient,
+		mediaClient: newMediaHttpClient(httpClient.Timeout),
+		clock:       clock,
+		blobStore:   blobStore,
+		searcher:    newSearcher(store.DB()),
 
-	cfg := mysql.Config{
-		User:      os.Getenv("MYSQL_USER"),
-		Passwd:    os.Getenv("MYSQL_PASSWORD"),
-		Net:       "tcp",
-		Addr:      os.Getenv("MYSQL_HOST") + ":3306",
-		DBName:    os.Getenv("MYSQL_DATABASE"),
-		ParseTime: true,
+		mastodonClients: map[string]*mastodon.Client{},
 	}
-
-	db, err = sql.Open("mysql", cfg.FormatDSN())
+	s.syncer = NewSyncer(s, config.SyncInterval)
+	s.backfiller = NewBackfiller(s)
+	s.streamer = NewStreamer(s)
+	s.exporter, err = NewExporter(s, config.ExportDir, filepath.Join(config.PublicDir, "export", "archive.html"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("NewServer: %v", err)
 	}
-	pingErr := db.Ping()
-	if pingErr != nil {
-		log.Fatal(pingErr)
+	s.echo = s.newEcho()
+	return s, nil
+}
+
+// ワーカーを動かさずにリクエストだけを処理するときに使う
+func (s *Server) Handler() http.Handler {
+	return s.echo
+}
+
+// ctxがキャンセルされるまでリクエストを受け付け、同期と遡りとエクスポートを動かす。設定されていればストリーミングも
+// キャンセルされたら処理中のリクエストとワーカーが終わるのを待ってから戻る
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.searcher.Init(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var workers sync.WaitGroup
+	workers.Add(4)
+	go func() {
+		defer workers.Done()
+		if err := s.snapshotStoredReblogs(ctx); err != nil && ctx.Err() == nil {
+			fmt.Println(err)
+		}
+	}()
+	go func() {
+		defer workers.Done()
+		s.syncer.Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		s.backfiller.Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		s.exporter.Run(ctx)
+	}()
+	if s.config.Streaming {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.streamer.Run(ctx)
+		}()
 	}
-	fmt.Println("datebase connection established.")
-	bundb = bun.NewDB(db, mysqldialect.New())
 
-	var errors []error
-	if _, err = bundb.NewCreateTable().Model((*App)(nil)).IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+	httpServer := &http.Server{Addr: s.config.Addr, Handler: s.Handler()}
+	listenErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("listening on %s\n", s.config.Addr)
+		listenErr <- httpServer.ListenAndServe()
+	}()
+	var err error
+	select {
+	case err = <-listenErr:
+	case <-ctx.Done():
+		fmt.Println("shutting down...")
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		err = httpServer.Shutdown(shutdownCtx)
+	}
+	cancel()
+	workers.Wait()
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	if _, err = bundb.NewCreateTable().Model((*Account)(nil)).IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+	return err
+}
+
+// DBにつないでServerを作る。サーバーとCLIのどちらからも呼ぶ
+// スキーマは起動のたびに最新までマイグレーションする
+func setup(ctx context.Context, config Config) (*Server, error) {
+	store, err := OpenStore(config.DatabaseUrl)
+	if err != nil {
+		return nil, err
 	}
-	if _, err = bundb.NewCreateTable().Model((*Status)(nil)).ForeignKey("(`account_id`, `host`) REFERENCES account (`id`, `host`) ON DELETE CASCADE").ForeignKey("(`visibility`) REFERENCES visibility (`visibility`) ON DELETE CASCADE ON UPDATE CASCADE").IfNotExists().Exec(ctx); err != nil {
-		errors = append(errors, err)
+	group, err := migrateUp(ctx, store)
+	if err != nil {
+		return nil, err
 	}
-	if 0 < len(errors) {
-		fmt.Printf("failed to initialize db table: %v", errors)
+	if !group.IsZero() {
+		fmt.Printf("migrated to %s\n", group)
 	}
+	return NewServer(config, store, nil, nil)
+}
 
-	t := &Template{
-		templates: template.Must(template.ParseGlob("public/views/*.html")),
+// SIGINTかSIGTERMを受け取ったら、処理中のリクエストを終えてから止まる
+func StartServer(config Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server, err := setup(ctx, config)
+	if err != nil {
+		log.Fatal(err)
 	}
+	if err := server.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
 
+func (s *Server) newEcho() *echo.Echo {
 	e := echo.New()
 	e.Use(middleware.Gzip())
-	e.Renderer = t
-	e.Static("/static", "assets")
+	e.Use(apiRouteErrors())
+	e.Use(s.limitImportBody())
+	e.Use(s.CSRF())
+	e.Renderer = NewTemplate(filepath.Join(s.config.PublicDir, "views", "*.html"), s.config.Location)
+	e.Static("/static", s.config.AssetsDir)
+	s.registerApiRoutes(e)
+	s.registerFeedRoutes(e)
+	s.registerRoutes(e)
+	return e
+}
+
+// CSRFがフォームを読む前に、アップロードされるアーカイブの大きさを制限する
+func (s *Server) limitImportBody() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() != "/imports" {
+				return next(c)
+			}
+			if c.Request().ContentLength > s.config.ImportMaxBytes {
+				return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("archive must be at most %d bytes", s.config.ImportMaxBytes))
+			}
+			c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, s.config.ImportMaxBytes)
+			return next(c)
+		}
+	}
+}
+
+func (s *Server) registerRoutes(e *echo.Echo) {
 	e.GET("/", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("GET", "/", c)
-		token, host, err := RequireLoggedIn(c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
 			return err
 		}
-		account, err := hGetVerifyCredentials(host, token)
+		host := session.Host
+		account, err := s.store.SelectAccount(ctx, session.AccountId, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		account, err = dSelectAccount(account.Id, host)
+		account = session.FillAccount(account)
+		query := c.QueryParam("q")
+		searchQuery := collectionSearchQuery(ParseSearchQuery(query, s.config.Location), c.QueryParam("collection"))
+		pageParams := ParsePageParams(c.QueryParams())
+		page, err := s.selectStatusPage(ctx, account.Id, host, searchQuery, pageParams)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		query := c.QueryParam("q")
-		allStatuses, err := dSelectStatusesByAccountAndText(account.Id, query)
+		for i, status := range page.Statuses {
+			page.Statuses[i].Snippet = highlightSnippet(status.Text, searchQuery.Terms())
+		}
+		allStatuses, err := s.attachMedia(ctx, page.Statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		prevUrl, nextUrl := pageLinks(c.Request().URL, page)
+		syncState, err := dSelectSyncState(ctx, s.db, account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		tagCounts, err := dSelectTagCounts(ctx, s.db, account.Id, host, nil, false)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		apiTokens, err := dSelectApiTokens(ctx, s.db, account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		exportJob, err := dSelectLatestExportJob(ctx, s.db, account.Id, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
+		syncJob, err := dSelectLatestSyncJob(ctx, s.db, account.Id, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		var collectionState CollectionState
+		if searchQuery.Collection != "" {
+			collectionState, err = dSelectCollectionState(ctx, s.db, account.Id, host, searchQuery.Collection)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+		}
 		noMoreNewerStatuses := c.QueryParam("noMoreNewerStatuses") == "true"
-		props := TopProps{Account: account, Statuses: allStatuses, AllFetched: account.AllFetched, NoMoreNewerStatuses: noMoreNewerStatuses, Public: account.Public}
+		syncQueued := c.QueryParam("syncQueued") == "true"
+		var importResult *ImportResult
+		if imported, err := strconv.Atoi(c.QueryParam("imported")); err == nil {
+			skipped, _ := strconv.Atoi(c.QueryParam("skipped"))
+			importResult = &ImportResult{Imported: imported, Skipped: skipped}
+		}
+		props := TopProps{Account: account, Statuses: allStatuses, AllFetched: account.AllFetched, NoMoreNewerStatuses: noMoreNewerStatuses, Public: account.Public, SyncState: syncState, SyncQueued: syncQueued, TagCloud: NewTagCloud(tagCounts, tagCloudSize), Query: query, PrevUrl: prevUrl, NextUrl: nextUrl, ApiTokens: apiTokens, Export: exportJob, Import: importResult, SyncJob: syncJob, Collection: searchQuery.Collection, CollectionState: collectionState}
 
 		return c.Render(http.StatusOK, "top", props)
 	})
 	e.POST("/status/cursor/head", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/status/cursor/head", c)
-		token, host, err := RequireLoggedIn(c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
 			return err
 		}
-		account, nil := hGetVerifyCredentials(host, token)
+		host := session.Host
+		if err := s.syncer.Trigger(ctx, session.AccountId, host); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/?syncQueued=true")
+	})
+	e.POST("/status/cursor/last", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/status/cursor/last", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
+			return err
+		}
+		host := session.Host
+		allFetched, err := s.store.SelectAccountAllFetched(ctx, session.AccountId, host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		if allFetched {
+			return c.Redirect(302, "/?allFetched=true")
+		}
+		if _, err := s.backfiller.Enqueue(ctx, session.AccountId, host, SyncJobBackfill); err != nil {
 			return SendAndOutputError(err)
 		}
-		newestStatusId, err := dSelectNewestStatusIdByAccount(account.Id)
+		return c.Redirect(302, "/")
+	})
+	e.POST("/status/reconcile", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/status/reconcile", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
+			return err
+		}
+		if _, err := s.backfiller.Enqueue(ctx, session.AccountId, session.Host, SyncJobReconcile); err != nil {
 			return SendAndOutputError(err)
 		}
-		newStatuses, nil := hGetAccountStatusesAll(host, token, account.Id, newestStatusId, "")
+		return c.Redirect(302, "/")
+	})
+	e.POST("/collections/:collection/backfill", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/collections/:collection/backfill", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
+			return err
+		}
+		collection := c.Param("collection")
+		if !IsCollection(collection) {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		if _, err := s.backfiller.Enqueue(ctx, session.AccountId, session.Host, collection); err != nil {
 			return SendAndOutputError(err)
 		}
-		if len(newStatuses) == 0 {
-			return c.Redirect(302, "/?noMoreNewerStatuses=true")
+		return c.Redirect(302, "/?collection="+collection)
+	})
+	e.POST("/sync_jobs/:id/cancel", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/sync_jobs/:id/cancel", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		err = s.backfiller.Cancel(ctx, c.Param("id"), session.AccountId, session.Host)
+		if err == ErrNotFound {
+			return c.String(http.StatusNotFound, "not found")
 		}
-		_, err = dInsertStatuses(newStatuses, account.Id, host)
 		if err != nil {
-			fmt.Printf("db insert error: %v", err)
+			return SendAndOutputError(err)
 		}
 		return c.Redirect(302, "/")
 	})
-	e.POST("/status/cursor/last", func(c echo.Context) error {
-		SendAndOutputError := HandlerError("POST", "/status/cursor/last", c)
-		token, host, err := RequireLoggedIn(c)
+	e.POST("/sync_jobs/:id/resume", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/sync_jobs/:id/resume", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
 			return err
 		}
-		account, nil := hGetVerifyCredentials(host, token)
+		_, err = s.backfiller.Resume(ctx, c.Param("id"), session.AccountId, session.Host)
+		if err == ErrNotFound {
+			return c.String(http.StatusNotFound, "not found")
+		}
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		allFetched, err := dSelectAccountAllFetchedById(account.Id, host)
+		return c.Redirect(302, "/")
+	})
+	e.POST("/exports", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/exports", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
+			return err
+		}
+		if _, err := s.exporter.Enqueue(ctx, session.AccountId, session.Host); err != nil {
 			return SendAndOutputError(err)
 		}
-		if allFetched {
-			return c.Redirect(302, "/?allFetched=true")
+		return c.Redirect(302, "/")
+	})
+	e.POST("/imports", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/imports", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
 		}
-		for {
-			oldestStatusId, err := dSelectOldestStatusIdByAccount(account.Id)
-			if err != nil {
-				return SendAndOutputError(err)
-			}
-			newStatuses, nil := hGetAccountStatusesOlderThan(host, token, account.Id, oldestStatusId)
-			if err != nil {
-				return SendAndOutputError(err)
-			}
-			if len(newStatuses) == 0 {
-				if err := dUpdateAccountAllFetched(account.Id); err != nil {
-					return SendAndOutputError(err)
-				}
-				return c.Redirect(302, "/")
-			}
-			_, err = dInsertStatuses(newStatuses, account.Id, host)
-			if err != nil {
-				fmt.Printf("db insert error: %v", err)
-			}
-			time.Sleep(time.Second * 2)
+		account, err := s.store.SelectAccount(ctx, session.AccountId, session.Host)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		fileHeader, err := c.FormFile("archive")
+		if err != nil {
+			return c.String(http.StatusBadRequest, "archive is required")
+		}
+		f, err := fileHeader.Open()
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		defer f.Close()
+		result, err := s.ImportArchiveFile(ctx, f, fileHeader.Size, fileHeader.Filename, account)
+		if err != nil {
+			return SendAndOutputError(err)
 		}
+		q := url.Values{"imported": {strconv.Itoa(result.Imported)}, "skipped": {strconv.Itoa(result.Skipped)}}
+		return c.Redirect(302, "/?"+q.Encode())
 	})
-	e.File("/login", "static/login.html")
-	e.GET("/logout", func(c echo.Context) error {
-		tokenCookie := &http.Cookie{
-			Name:    "token",
-			Value:   "",
-			Expires: time.Unix(0, 0),
-		}
-		c.SetCookie(tokenCookie)
-		hostCookie := &http.Cookie{
-			Name:    "host",
-			Value:   "",
-			Expires: time.Unix(0, 0),
-		}
-		c.SetCookie(hostCookie)
+	e.GET("/exports/:id", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/exports/:id", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		job, err := dSelectExportJob(ctx, s.db, c.Param("id"), session.AccountId, session.Host)
+		if err == ErrNotFound || (err == nil && job.State != ExportDone) {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		name := fmt.Sprintf("activitypublog-%s-%s-%s.zip", session.UserName, session.Host, job.CreatedAt.Format("20060102"))
+		return c.Attachment(s.exporter.Path(job), name)
+	})
+	e.GET("/login", func(c echo.Context) error {
+		return c.Render(http.StatusOK, "login", nil)
+	})
+	// 同期も止まるので、他のサイトから踏ませられないようにPOSTでCSRFトークンを確かめる
+	e.POST("/logout", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/logout", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		// トークンはインスタンス側でも無効にするので、以後の同期も止まる
+		// 取り消せなくても、保存しているトークンは消す
+		token, err := dSelectCredentialToken(ctx, s.db, s.config.CredentialKey, session.AccountId, session.Host)
+		if err == nil {
+			if app, err := s.store.SelectAppByHost(ctx, session.Host); err != nil {
+				fmt.Printf("logout: %v\n", err)
+			} else if err := hPostOauthRevoke(ctx, s.mastodonClient(session.Host, ""), app, token); err != nil {
+				fmt.Printf("logout: %v\n", err)
+			}
+			s.forgetMastodonClient(session.Host, token)
+		}
+		if err := dDeleteCredential(ctx, s.db, session.AccountId, session.Host); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := s.EndSession(c, session); err != nil {
+			return SendAndOutputError(err)
+		}
 		return c.Redirect(302, "/login")
 	})
 	e.POST("/sign_in", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/sign_in", c)
+		ctx := c.Request().Context()
 		host := c.FormValue("host")
-		app, err := dSelectAppByHost(host)
+		app, err := s.store.SelectAppByHost(ctx, host)
 		if err != nil {
 			fmt.Println("app data was not found in db. fetch it.")
-			app, err = hPostApp(host, os.Getenv("BASE_URL"))
+			app, err = hPostApp(ctx, s.mastodonClient(host, ""), s.config.BaseUrl, s.config.OAuthClientName)
 			if err != nil {
 				return SendAndOutputError(err)
 			}
-			err = dInsertApp(app)
+			err = s.store.InsertApp(ctx, app)
 			if err != nil {
 				return SendAndOutputError(err)
 			}
@@ -207,101 +478,213 @@ func StartServer() {
 		u.Scheme = "https"
 		u.Host = host
 		u.Path = "/oauth/authorize"
-		q := url.Values{"response_type": {"code"}, "client_id": {app.ClientId}, "redirect_uri": {os.Getenv("BASE_URL") + "/authorize"}}
+		state, err := randomString(16)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		q := url.Values{"response_type": {"code"}, "client_id": {app.ClientId}, "redirect_uri": {s.config.BaseUrl + "/authorize"}, "state": {state}}
 		u.RawQuery = q.Encode()
 		cookie := &http.Cookie{
-			Name:    "authentication-ongoing-instance-name",
-			Value:   host,
-			Expires: time.Now().Add(5 * time.Minute),
-			Path:    "/authorize",
+			Name:     "authentication-ongoing-instance-name",
+			Value:    host,
+			Expires:  s.clock.Now().Add(5 * time.Minute),
+			Path:     "/authorize",
+			HttpOnly: true,
+			Secure:   s.secureCookie(),
+			SameSite: http.SameSiteLaxMode,
 		}
 		c.SetCookie(cookie)
+		// stateはインスタンス名と組にして署名し、コールバックで同じログイン要求から戻ってきたことを確かめる
+		stateCookie := &http.Cookie{
+			Name:     "authentication-ongoing-state",
+			Value:    sign(s.config.SessionSecret, host+" "+state),
+			Expires:  s.clock.Now().Add(5 * time.Minute),
+			Path:     "/authorize",
+			HttpOnly: true,
+			Secure:   s.secureCookie(),
+			SameSite: http.SameSiteLaxMode,
+		}
+		c.SetCookie(stateCookie)
 		return c.Redirect(302, u.String())
 	})
 	e.GET("/authorize", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("GET", "/authorize", c)
+		ctx := c.Request().Context()
 		cookie, err := c.Cookie("authentication-ongoing-instance-name")
 		if err != nil {
 			return c.Redirect(302, "/")
 		}
 		host := cookie.Value
-		code := c.QueryParam("code")
-		u := url.URL{}
-		u.Scheme = "https"
-		u.Host = host
-		u.Path = "/oauth/token"
-		app, err := dSelectAppByHost(host)
+		stateCookie, err := c.Cookie("authentication-ongoing-state")
 		if err != nil {
-			return SendAndOutputError(err)
+			return c.Redirect(302, "/")
 		}
-		q := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {app.ClientId}, "client_secret": {app.ClientSecret}, "redirect_uri": {os.Getenv("BASE_URL") + "/authorize"}}
-		resp, err := http.PostForm(u.String(), q)
-		if err != nil {
-			return c.String(http.StatusBadRequest, fmt.Sprintf("failed to create app for the host: %v", err))
+		expectedState, ok := verifySigned(s.config.SessionSecret, stateCookie.Value)
+		if !ok || subtle.ConstantTimeCompare([]byte(expectedState), []byte(host+" "+c.QueryParam("state"))) != 1 {
+			return c.String(http.StatusBadRequest, "invalid state")
+		}
+		for _, name := range []string{"authentication-ongoing-instance-name", "authentication-ongoing-state"} {
+			c.SetCookie(&http.Cookie{Name: name, Value: "", Expires: time.Unix(0, 0), Path: "/authorize"})
 		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		app, err := s.store.SelectAppByHost(ctx, host)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to read response from server: %v", err))
+			return SendAndOutputError(err)
 		}
-		var r PostOauthTokenResponse
-		if err := json.Unmarshal(body, &r); err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("failed to parse response from server: %v", err))
+		r, err := hPostOauthToken(ctx, s.mastodonClient(host, ""), app, c.QueryParam("code"), s.config.BaseUrl+"/authorize")
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
 		}
-		account, err := hGetVerifyCredentials(host, r.AccessToken)
+		account, err := hGetVerifyCredentials(ctx, s.mastodonClient(host, r.AccessToken))
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		_, err = dInsertAccountIfNotExists(account.Id, account.UserName, host)
+		_, err = s.store.InsertAccountIfNotExists(ctx, account.Id, account.UserName, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		tokenCookie := &http.Cookie{
-			Name:    "token",
-			Value:   r.AccessToken,
-			Expires: time.Now().Add(24 * 7 * time.Hour),
+		if err := dUpsertCredential(ctx, s.db, s.config.CredentialKey, account.Id, host, r.AccessToken, r.Scope, s.clock.Now()); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := dInsertSyncStateIfNotExists(ctx, s.db, account.Id, host, s.clock.Now()); err != nil {
+			return SendAndOutputError(err)
 		}
-		c.SetCookie(tokenCookie)
-		hostCookie := &http.Cookie{
-			Name:    "host",
-			Value:   host,
-			Expires: time.Now().Add(24 * 7 * time.Hour),
+		s.streamer.Refresh()
+		if err := s.StartSession(c, account, host); err != nil {
+			return SendAndOutputError(err)
 		}
-		c.SetCookie(hostCookie)
 		return c.Redirect(302, "/")
 	})
-	e.GET("/users/:host/:username", func(c echo.Context) error {
-		SendAndOutputError := HandlerError("GET", "/users/:host/:username", c)
+	usersPage := func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", c.Path(), c)
+		ctx := c.Request().Context()
 		username := c.Param("username")
 		host := c.Param("host")
-		account, err := dSelectAccountByUserName(username, host)
+		tag := c.Param("name")
+		account, err := s.store.SelectAccountByUserName(ctx, username, host)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 		if !account.Public {
 			return c.String(http.StatusNotFound, "not found")
 		}
-		statuses, err := dSelectStatusesByAccountWithRestriction(username, host)
+		page, err := s.store.SelectStatusesByAccountWithRestriction(ctx, username, host, tag, ParsePageParams(c.QueryParams()))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err := s.attachMedia(ctx, page.Statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		tagCounts, err := dSelectTagCounts(ctx, s.db, account.Id, host, account.PublicVisibilities(), account.HideDeleted)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
 
-		props := UsersProps{Host: host, UserName: username, Statuses: statuses}
+		prevUrl, nextUrl := pageLinks(c.Request().URL, page)
+		props := UsersProps{Host: host, UserName: username, Statuses: statuses, Tag: normalizeTagName(tag), TagCloud: NewTagCloud(tagCounts, tagCloudSize), PrevUrl: prevUrl, NextUrl: nextUrl}
 
 		return c.Render(http.StatusOK, "users", props)
+	}
+	e.GET("/users/:host/:username", usersPage)
+	e.GET("/users/:host/:username/tags/:name", usersPage)
+	e.GET("/tags/:name", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/tags/:name", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		tag := normalizeTagName(c.Param("name"))
+		page, err := dSelectStatusesByAccountAndTag(ctx, s.db, session.AccountId, session.Host, tag, ParsePageParams(c.QueryParams()))
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		statuses, err := s.attachMedia(ctx, page.Statuses)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		prevUrl, nextUrl := pageLinks(c.Request().URL, page)
+		props := TagProps{Tag: tag, Statuses: statuses, PrevUrl: prevUrl, NextUrl: nextUrl}
+		return c.Render(http.StatusOK, "tag", props)
 	})
-	e.POST("/status/public", func(c echo.Context) error {
-		SendAndOutputError := HandlerError("POST", "/status/public", c)
-		token, host, err := RequireLoggedIn(c)
+	e.GET("/media/:hash", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("GET", "/media/:hash", c)
+		ctx := c.Request().Context()
+		hash := c.Param("hash")
+		attachments, statuses, err := dSelectMediaByBlobHash(ctx, s.db, hash)
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		allowed := false
+		contentType := ""
+		for i, status := range statuses {
+			ok, err := s.CanViewStatus(c, status)
+			if err != nil {
+				return SendAndOutputError(err)
+			}
+			if !ok {
+				continue
+			}
+			allowed = true
+			contentType = attachments[i].ContentType
+			if hash != attachments[i].BlobHash {
+				contentType = attachments[i].PreviewContentType
+			}
+			break
+		}
+		if !allowed {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		r, err := s.blobStore.Get(ctx, hash)
+		if err == ErrBlobNotFound {
+			return c.String(http.StatusNotFound, "not found")
+		}
+		if err != nil {
+			return SendAndOutputError(err)
+		}
+		defer r.Close()
+		// 内容のハッシュがURLなので中身が変わることはない
+		c.Response().Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		// 中身はインスタンスから来たものなので、ブラウザに推測させず、直接開かれてもスクリプトは動かさない
+		c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+		c.Response().Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		return c.Stream(http.StatusOK, servableMediaType(contentType), r)
+	})
+	e.POST("/api_tokens", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/api_tokens", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
 			return err
 		}
-		public := c.FormValue("public") == "true"
-		account, nil := hGetVerifyCredentials(host, token)
+		apiToken, token, err := s.IssueApiToken(ctx, session.AccountId, session.Host, c.FormValue("name"))
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		err = dUpdateAccountPublic(account.Id, host, public)
+		return c.Render(http.StatusOK, "api_token", ApiTokenProps{ApiToken: apiToken, Token: token})
+	})
+	e.POST("/api_tokens/:id/delete", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/api_tokens/:id/delete", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		if _, err := dDeleteApiToken(ctx, s.db, c.Param("id"), session.AccountId, session.Host); err != nil {
+			return SendAndOutputError(err)
+		}
+		return c.Redirect(302, "/")
+	})
+	e.POST("/status/public", func(c echo.Context) error {
+		SendAndOutputError := HandlerError("POST", "/status/public", c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
+		if err != nil {
+			return err
+		}
+		host := session.Host
+		public := c.FormValue("public") == "true"
+		err = s.store.UpdateAccountPublic(ctx, session.AccountId, host, public)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
@@ -309,23 +692,25 @@ func StartServer() {
 	})
 	e.POST("/account/visibility", func(c echo.Context) error {
 		SendAndOutputError := HandlerError("POST", "/account/visibility", c)
-		token, host, err := RequireLoggedIn(c)
+		ctx := c.Request().Context()
+		session, err := s.RequireLoggedIn(c)
 		if err != nil {
 			return err
 		}
+		host := session.Host
 		showUnlisted := c.FormValue("unlisted") == "on"
 		showPrivate := c.FormValue("private") == "on"
 		showDirect := c.FormValue("direct") == "on"
-		account, nil := hGetVerifyCredentials(host, token)
+		err = s.store.UpdateAccountVisibility(ctx, session.AccountId, host, showUnlisted, showPrivate, showDirect)
 		if err != nil {
 			return SendAndOutputError(err)
 		}
-		err = dUpdateAccountVisibility(account.Id, host, showUnlisted, showPrivate, showDirect)
-		if err != nil {
+		if err := s.store.UpdateAccountHideDeleted(ctx, session.AccountId, host, c.FormValue("hide_deleted") == "on"); err != nil {
+			return SendAndOutputError(err)
+		}
+		if err := s.store.UpdateAccountShowReblogs(ctx, session.AccountId, host, c.FormValue("show_reblogs") == "on"); err != nil {
 			return SendAndOutputError(err)
 		}
 		return c.Redirect(302, "/")
 	})
-
-	e.Logger.Fatal(e.Start(":1323"))
 }
@@ -0,0 +1,52 @@
+package activitypublog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.t
+}
+
+// 一時ディレクトリのSQLiteを使うServer
+// ワーカーは動かさないので、テストから直接呼ぶ
+func newTestServer(t *testing.T, clock Clock) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	config, err := parseConfig(testConfigValues(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config, newTestStore(t), nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// 既定値に、テストで動くのに必要な値を重ねたもの
+func testConfigValues(dir string) map[string]string {
+	values := map[string]string{}
+	for _, key := range configKeys {
+		values[key.env] = key.defaultValue
+	}
+	for key, value := range map[string]string{
+		"BASE_URL":         "http://localhost",
+		"DATABASE_URL":     "sqlite:" + filepath.Join(dir, "test.db"),
+		"CREDENTIAL_KEY":   "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		"SESSION_SECRET":   "0123456789abcdef0123456789abcdef",
+		"REQUEST_INTERVAL": "0s",
+		"EXPORT_DIR":       filepath.Join(dir, "exports"),
+		"MEDIA_STORAGE":    "local",
+		"MEDIA_DIR":        filepath.Join(dir, "media"),
+	} {
+		values[key] = value
+	}
+	return values
+}
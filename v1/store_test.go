@@ -0,0 +1,304 @@
+package activitypublog
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testHost = "example.com"
+
+// 一時ディレクトリのSQLiteにマイグレーションを当てたStore
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := OpenStore("sqlite:" + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	if _, err := migrateUp(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// idsの順に、その時刻に投稿したことにする
+func testStatuses(accountId string, host string, ids ...string) []Status {
+	var statuses []Status
+	for i, id := range ids {
+		statuses = append(statuses, Status{
+			Id:         id,
+			Host:       host,
+			AccountId:  accountId,
+			Text:       "status " + id,
+			Visibility: "public",
+			CreatedAt:  time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+		})
+	}
+	return statuses
+}
+
+func TestUpsertStatuses(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	statuses := testStatuses("1", testHost, "10", "11")
+	statuses[0].Tags = []Tag{{Name: "go"}}
+	statuses[0].MediaAttachments = []MediaAttachment{{Id: "m1", StatusId: "10", Host: testHost, Type: "image", RemoteUrl: "https://example.com/m1.png"}}
+	result, err := store.UpsertStatuses(ctx, statuses, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Inserted: 2}); result != want {
+		t.Errorf("first upsert = %v, want %v", result, want)
+	}
+
+	status, err := store.SelectStatus(ctx, "10", "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Text != "status 10" || !status.CreatedAt.Equal(statuses[0].CreatedAt) {
+		t.Errorf("status = %+v", status)
+	}
+	existing, err := store.SelectExistingStatusIds(ctx, []string{"10", "12"}, testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"10": true}; !reflect.DeepEqual(existing, want) {
+		t.Errorf("existing = %v, want %v", existing, want)
+	}
+	page, err := store.SelectStatusesByAccountWithRestriction(ctx, "alice", testHost, "go", PageParams{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Statuses) != 1 || page.Statuses[0].Id != "10" {
+		t.Errorf("statuses tagged go = %+v, want 10", page.Statuses)
+	}
+
+	result, err = store.UpsertStatuses(ctx, statuses, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Unchanged: 2}); result != want {
+		t.Errorf("same upsert = %v, want %v", result, want)
+	}
+
+	edited := statuses[0]
+	edited.Text = "edited"
+	edited.EditedAt = edited.CreatedAt.Add(time.Hour)
+	result, err = store.UpsertStatuses(ctx, []Status{edited}, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Updated: 1}); result != want {
+		t.Errorf("edited upsert = %v, want %v", result, want)
+	}
+	status, err = store.SelectStatus(ctx, "10", "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Text != "edited" {
+		t.Errorf("text = %q, want edited", status.Text)
+	}
+	revisions, err := dSelectStatusRevisions(ctx, store.DB(), "10", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Text != "status 10" || !revisions[0].ReplacedAt.Equal(edited.EditedAt) {
+		t.Errorf("revisions = %+v, want the text before the edit", revisions)
+	}
+
+	// 削除済みにした投稿がまた返ってきたら戻す
+	if _, err := dMarkStatusesDeleted(ctx, store.DB(), "1", testHost, []string{"11"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	result, err = store.UpsertStatuses(ctx, statuses[1:], "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Updated: 1}); result != want {
+		t.Errorf("restored upsert = %v, want %v", result, want)
+	}
+	status, err = store.SelectStatus(ctx, "11", "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.DeletedAt.IsZero() {
+		t.Errorf("deleted_at = %v, want zero", status.DeletedAt)
+	}
+}
+
+// 本文やrawを保存する前に入れた投稿は、APIから返ってきたら前の版を残さずに書き換える
+func TestUpsertStatusesRefreshesLegacyStatus(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	legacy := testStatuses("1", testHost, "30")
+	if _, err := store.UpsertStatuses(ctx, legacy, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DB().NewUpdate().Model((*Status)(nil)).Set("raw = NULL, content = ''").Where("id = ?", "30").Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := testStatuses("1", testHost, "30")
+	fetched[0].Content = "<p>status 30</p>"
+	fetched[0].Raw = json.RawMessage(`{"id":"30"}`)
+	fetched[0].Tags = []Tag{{Name: "go"}}
+	result, err := store.UpsertStatuses(ctx, fetched, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Updated: 1}); result != want {
+		t.Errorf("upsert = %v, want %v", result, want)
+	}
+	status, err := store.SelectStatus(ctx, "30", "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Content != "<p>status 30</p>" {
+		t.Errorf("content = %q, want the fetched content", status.Content)
+	}
+	tags, err := dSelectStatusTagsByStatuses(ctx, store.DB(), []Status{status})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].TagName != "go" {
+		t.Errorf("tags = %+v, want go", tags)
+	}
+	revisions, err := dSelectStatusRevisions(ctx, store.DB(), "30", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("revisions = %+v, want none", revisions)
+	}
+
+	// 書き換えたあとは同じものが返ってきても何もしない
+	result, err = store.UpsertStatuses(ctx, fetched, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Unchanged: 1}); result != want {
+		t.Errorf("second upsert = %v, want %v", result, want)
+	}
+}
+
+func TestUpsertStatusesClaimsCollectionStatus(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	collected := testStatuses("1", testHost, "20")
+	collected[0].Source = StatusSourceCollection
+	if _, err := store.UpsertStatuses(ctx, collected, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	newest, err := store.SelectNewestStatusId(ctx, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newest != "" {
+		t.Errorf("newest = %q, want no status from a collection", newest)
+	}
+
+	result, err := store.UpsertStatuses(ctx, testStatuses("1", testHost, "20"), "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UpsertResult{Inserted: 1}); result != want {
+		t.Errorf("upsert = %v, want %v", result, want)
+	}
+	newest, err = store.SelectNewestStatusId(ctx, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newest != "20" {
+		t.Errorf("newest = %q, want 20", newest)
+	}
+}
+
+func TestSelectStatusesByAccountPaging(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	// 文字列として比べると順番が変わるように桁数を混ぜる
+	ids := []string{"9", "99", "100", "1000", "99999", "109876543210987654", "110000000000000000"}
+	if _, err := store.UpsertStatuses(ctx, testStatuses("1", testHost, ids...), "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+
+	newest, err := store.SelectNewestStatusId(ctx, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, err := store.SelectOldestStatusId(ctx, "1", testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newest != "110000000000000000" || oldest != "9" {
+		t.Errorf("newest, oldest = %q, %q", newest, oldest)
+	}
+
+	var got []string
+	page := PageParams{Limit: 3}
+	for i := 0; ; i++ {
+		if i > len(ids) {
+			t.Fatal("paging does not end")
+		}
+		p, err := store.SelectStatusesByAccount(ctx, "1", testHost, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range p.Statuses {
+			got = append(got, status.Id)
+		}
+		if p.NextMaxId == "" {
+			break
+		}
+		page = PageParams{Limit: 3, MaxId: p.NextMaxId}
+	}
+	want := []string{"110000000000000000", "109876543210987654", "99999", "1000", "100", "99", "9"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	p, err := store.SelectStatusesByAccount(ctx, "1", testHost, PageParams{Limit: 2, MinId: "99"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, status := range p.Statuses {
+		got = append(got, status.Id)
+	}
+	if want := []string{"1000", "100"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("min_id page = %v, want %v", got, want)
+	}
+}
+
+// 投稿がなければ問い合わせずに空を返す。条件なしで全部を読んではいけない
+func TestSelectStatusTagsByNoStatuses(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	if _, err := store.InsertAccountIfNotExists(ctx, "1", "alice", testHost); err != nil {
+		t.Fatal(err)
+	}
+	statuses := testStatuses("1", testHost, "40")
+	statuses[0].Tags = []Tag{{Name: "go"}}
+	if _, err := store.UpsertStatuses(ctx, statuses, "1", testHost); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := dSelectStatusTagsByStatuses(ctx, store.DB(), nil); err != nil || len(tags) != 0 {
+		t.Errorf("tags = %+v, %v, want empty", tags, err)
+	}
+}
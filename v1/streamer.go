@@ -0,0 +1,171 @@
+package activitypublog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chao7150/activitypublog/mastodon"
+)
+
+const (
+	// 認証情報が増えたり消えたりしていないかを見る間隔
+	streamRefreshInterval = time.Minute
+	// つなぎ直すまでの待ち時間。失敗するたびに倍にする
+	streamMinBackoff = 5 * time.Second
+	streamMaxBackoff = 5 * time.Minute
+	// これより長くつながっていたら、次に切れたときの待ち時間を最初に戻す
+	streamStableDuration = time.Minute
+)
+
+// ストリーミングAPIで自分の投稿をすぐに取り込むワーカー
+// 認証情報を保存しているアカウントごとに接続を1つ持ち、切れたら待ってからつなぎ直す
+// つながっていない間の投稿は、つなぐたびに新しい投稿の同期をして取り込む
+type Streamer struct {
+	server *Server
+	kick   chan struct{}
+}
+
+func NewStreamer(server *Server) *Streamer {
+	return &Streamer{server: server, kick: make(chan struct{}, 1)}
+}
+
+// ログインして認証情報が増えたときに、次の確認を待たずにつなぐ
+func (st *Streamer) Refresh() {
+	select {
+	case st.kick <- struct{}{}:
+	default:
+	}
+}
+
+// ctxがキャンセルされるまで戻らない。戻るときにはすべての接続を閉じている
+func (st *Streamer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	running := map[Credential]context.CancelFunc{}
+	ticker := time.NewTicker(streamRefreshInterval)
+	defer ticker.Stop()
+	for {
+		st.refresh(ctx, &wg, running)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-st.kick:
+		}
+	}
+}
+
+// 認証情報のあるアカウントの接続を始め、ログアウトなどで認証情報が消えたアカウントの接続を閉じる
+func (st *Streamer) refresh(ctx context.Context, wg *sync.WaitGroup, running map[Credential]context.CancelFunc) {
+	credentials, err := dSelectCredentialAccounts(ctx, st.server.db)
+	if err != nil {
+		fmt.Printf("stream: failed to select credentials: %v\n", err)
+		return
+	}
+	current := map[Credential]bool{}
+	for _, credential := range credentials {
+		key := Credential{AccountId: credential.AccountId, Host: credential.Host}
+		current[key] = true
+		if _, ok := running[key]; ok {
+			continue
+		}
+		streamCtx, cancel := context.WithCancel(ctx)
+		running[key] = cancel
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.stream(streamCtx, key.AccountId, key.Host)
+		}()
+	}
+	for key, cancel := range running {
+		if !current[key] {
+			cancel()
+			delete(running, key)
+		}
+	}
+}
+
+func (st *Streamer) stream(ctx context.Context, accountId string, host string) {
+	backoff := streamMinBackoff
+	for {
+		connectedAt := time.Now()
+		err := st.server.streamAccount(ctx, accountId, host)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("stream %s@%s: %v\n", accountId, host, err)
+		if time.Since(connectedAt) > streamStableDuration {
+			backoff = streamMinBackoff
+		}
+		// トークンが無効になっていれば、ログインし直すまで何度つないでも失敗する
+		if errors.Is(err, mastodon.ErrUnauthorized) {
+			backoff = streamMaxBackoff
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// 切れるまで戻らない
+func (s *Server) streamAccount(ctx context.Context, accountId string, host string) error {
+	token, err := dSelectCredentialToken(ctx, s.db, s.config.CredentialKey, accountId, host)
+	if err != nil {
+		return err
+	}
+	client := s.mastodonClient(host, token)
+	stream, err := client.StreamUser(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	// つないでから同期するので、その間に投稿されたものも取りこぼさない。両方から届いた投稿は重ねて取り込まれるだけ
+	result, err := s.syncHead(ctx, client, accountId)
+	if err != nil {
+		return fmt.Errorf("head: %w", err)
+	}
+	fmt.Printf("stream %s@%s: connected, %s\n", accountId, host, result)
+	for {
+		event, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		if err := s.handleStreamEvent(ctx, event, accountId, host); err != nil {
+			return err
+		}
+	}
+}
+
+// ホームタイムラインには他人の投稿も流れてくるので、自分の投稿だけを取り込む
+func (s *Server) handleStreamEvent(ctx context.Context, event mastodon.Event, accountId string, host string) error {
+	switch event.Event {
+	case mastodon.EventUpdate, mastodon.EventStatusUpdate:
+		v, err := event.Status()
+		if err != nil {
+			return err
+		}
+		if v.Account.Id != accountId {
+			return nil
+		}
+		if _, err := s.ingestStatuses(ctx, []Status{hConvertStatus(v, host, accountId)}, accountId, host); err != nil {
+			return err
+		}
+		return s.archivePendingMedia(ctx, accountId, host)
+	case mastodon.EventDelete:
+		// 他人の投稿のIDならどの行にも当たらない
+		_, err := dMarkStatusesDeleted(ctx, s.db, accountId, host, []string{event.Payload}, s.clock.Now())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package activitypublog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/chao7150/activitypublog/mastodon"
+)
+
+// 認証情報を保存しているアカウントの新しい投稿を定期的にDBへ取り込むワーカー
+// Streamerも同じアカウントの投稿を取り込むが、取り込みは同じ投稿を何度行ってもよいので並行して走ってかまわない
+type Syncer struct {
+	server   *Server
+	interval time.Duration
+	kick     chan struct{}
+}
+
+func NewSyncer(server *Server, interval time.Duration) *Syncer {
+	return &Syncer{
+		server:   server,
+		interval: interval,
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// 次回のtickを待たずに同期させる
+func (s *Syncer) Trigger(ctx context.Context, accountId string, host string) error {
+	if err := dUpdateSyncStateNextRunAt(ctx, s.server.db, accountId, host, s.server.clock.Now()); err != nil {
+		return err
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ctxがキャンセルされるまで戻らない
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.runDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+	}
+}
+
+func (s *Syncer) runDue(ctx context.Context) {
+	states, err := dSelectDueSyncStates(ctx, s.server.db, s.server.clock.Now())
+	if err != nil {
+		fmt.Printf("sync: failed to select due accounts: %v\n", err)
+		return
+	}
+	for _, state := range states {
+		if ctx.Err() != nil {
+			return
+		}
+		token, err := dSelectCredentialToken(ctx, s.server.db, s.server.config.CredentialKey, state.AccountId, state.Host)
+		if err != nil {
+			fmt.Printf("sync %s@%s: %v\n", state.AccountId, state.Host, err)
+			continue
+		}
+		startedAt := s.server.clock.Now()
+		errString := ""
+		if err := s.server.syncAccount(ctx, state.Host, token, state.AccountId); err != nil {
+			errString = err.Error()
+			if errors.Is(err, mastodon.ErrUnauthorized) {
+				errString = "インスタンスがトークンを受け付けませんでした。ログインし直してください: " + errString
+			}
+			fmt.Printf("sync %s@%s: %v\n", state.AccountId, state.Host, err)
+		}
+		if err := dUpdateSyncStateFinished(ctx, s.server.db, state.AccountId, state.Host, startedAt, startedAt.Add(s.interval), errString); err != nil {
+			fmt.Printf("sync: failed to update state: %v\n", err)
+		}
+	}
+}
+
+// 新しい投稿を取り込む。古い投稿を遡るのはBackfillerのジョブで、まだ一度も遡っていなければここでジョブを作る
+func (s *Server) syncAccount(ctx context.Context, host string, token string, accountId string) error {
+	client := s.mastodonClient(host, token)
+	result, err := s.syncHead(ctx, client, accountId)
+	if err != nil {
+		return fmt.Errorf("head: %w", err)
+	}
+	fmt.Printf("sync %s@%s: %s\n", accountId, host, result)
+	allFetched, err := s.store.SelectAccountAllFetched(ctx, accountId, host)
+	if err != nil {
+		return err
+	}
+	if !allFetched {
+		if err := s.enqueueSyncJobOnce(ctx, accountId, host, SyncJobBackfill); err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+	}
+	// お気に入りとブックマークが取得できなくても、自分の投稿のメディアは保存する
+	collectionErr := s.syncCollections(ctx, client, accountId)
+	if err := s.archivePendingMedia(ctx, accountId, host); err != nil {
+		return fmt.Errorf("media: %v", err)
+	}
+	return collectionErr
+}
+
+// その種類のジョブを一度も作っていなければ作る
+// 止めたり失敗したりしたジョブは、ユーザーが再開するまでそのままにする
+// 別の種類のジョブが動いていれば作らないので、次の同期でまた試す
+func (s *Server) enqueueSyncJobOnce(ctx context.Context, accountId string, host string, kind string) error {
+	job, err := dSelectLatestSyncJobOfKind(ctx, s.db, accountId, host, kind)
+	if err != nil || job.Id != "" {
+		return err
+	}
+	_, err = s.backfiller.Enqueue(ctx, accountId, host, kind)
+	return err
+}
+
+// DBにある一番新しい投稿より新しい投稿を取り込む
+// min_idから新しい方へたどるので、途中で止まってもDBの投稿は隙間なくつながっている
+func (s *Server) syncHead(ctx context.Context, client *mastodon.Client, accountId string) (UpsertResult, error) {
+	var result UpsertResult
+	host := client.Host
+	newestStatusId, err := s.store.SelectNewestStatusId(ctx, accountId, host)
+	if err != nil {
+		return result, err
+	}
+	params := url.Values{}
+	if newestStatusId != "" {
+		params.Set("min_id", newestStatusId)
+	}
+	err = hForEachAccountStatusPage(ctx, client, accountId, params, mastodon.RelPrev, func(statuses []Status) error {
+		r, err := s.ingestStatuses(ctx, statuses, accountId, host)
+		result.Add(r)
+		return err
+	})
+	return result, err
+}
+
+// DBにある一番古い投稿より古い投稿を、インスタンスが返さなくなるまで取り込む
+// 1ページごとに保存するので、途中で止まっても次は続きから取得する
+// onPageは1ページ保存するたびにそのページの結果と一緒に呼ばれ、エラーを返すとそこで止まる
+func (s *Server) syncBackfill(ctx context.Context, client *mastodon.Client, accountId string, onPage func(statuses []Status, result UpsertResult) error) error {
+	host := client.Host
+	oldestStatusId, err := s.store.SelectOldestStatusId(ctx, accountId, host)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	if oldestStatusId != "" {
+		params.Set("max_id", oldestStatusId)
+	}
+	err = hForEachAccountStatusPage(ctx, client, accountId, params, mastodon.RelNext, func(statuses []Status) error {
+		result, err := s.ingestStatuses(ctx, statuses, accountId, host)
+		if err != nil {
+			return err
+		}
+		return onPage(statuses, result)
+	})
+	if err != nil {
+		return err
+	}
+	return s.store.UpdateAccountAllFetched(ctx, accountId, host)
+}
+
+// インスタンスの投稿を新しい方から最後までたどり、保存済みの投稿のうち返ってこなかったものを削除済みにする
+// 1ページ取り込むたびに、そのページから前のページまでの間だけを調べるので、途中で止まっても調べ終えたところは正しい
+// たどっている間に投稿されたものを間違えて削除済みにしないように、最初のページの一番新しい投稿より新しいものは調べない
+// アーカイブから取り込んだ投稿はインスタンスにないことがあるので調べない
+// たどったページは取り込むので、編集された投稿もここで書き換わる
+// maxIdを渡すとその投稿より古い方から続ける。onPageにはそのページで削除済みにした数も渡す
+// 最後のページより古い投稿は、たどり終えてから削除済みにして、その数を返す
+func (s *Server) syncReconcile(ctx context.Context, client *mastodon.Client, accountId string, maxId string, onPage func(statuses []Status, result UpsertResult, deleted int64) error) (int64, error) {
+	host := client.Host
+	params := url.Values{}
+	if maxId != "" {
+		params.Set("max_id", maxId)
+	}
+	// 前のページの一番古い投稿。ここより新しいところは調べ終えている
+	upper := maxId
+	err := hForEachAccountStatusPage(ctx, client, accountId, params, mastodon.RelNext, func(statuses []Status) error {
+		result, err := s.ingestStatuses(ctx, statuses, accountId, host)
+		if err != nil {
+			return err
+		}
+		oldest, newest := statuses[0].Id, statuses[0].Id
+		for _, status := range statuses {
+			if compareStatusIds(status.Id, oldest) < 0 {
+				oldest = status.Id
+			}
+			if compareStatusIds(status.Id, newest) > 0 {
+				newest = status.Id
+			}
+		}
+		if upper != "" {
+			newest = upper
+		}
+		deleted, err := s.markUnseenStatusesDeleted(ctx, accountId, host, oldest, newest, statuses)
+		if err != nil {
+			return err
+		}
+		upper = oldest
+		return onPage(statuses, result, deleted)
+	})
+	if err != nil {
+		return 0, err
+	}
+	// 1ページも返ってこなかったら、インスタンスが一時的に空を返しただけかもしれないので何も削除済みにしない
+	if upper == "" && maxId == "" {
+		return 0, nil
+	}
+	return s.markUnseenStatusesDeleted(ctx, accountId, host, "", upper, nil)
+}
+
+// oldestIdからnewestIdまでの投稿のうち、statusesにもnewestIdにもないものを削除済みにする
+// newestIdは前のページで返ってきた投稿なので残す
+func (s *Server) markUnseenStatusesDeleted(ctx context.Context, accountId string, host string, oldestId string, newestId string, statuses []Status) (int64, error) {
+	ids, err := dSelectReconcileStatusIds(ctx, s.db, accountId, host, oldestId, newestId)
+	if err != nil {
+		return 0, err
+	}
+	seen := map[string]bool{newestId: true}
+	for _, status := range statuses {
+		seen[status.Id] = true
+	}
+	var deleted []string
+	for _, id := range ids {
+		if !seen[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	return dMarkStatusesDeleted(ctx, s.db, accountId, host, deleted, s.clock.Now())
+}
+
+// 取得した投稿をDBと検索インデックスに入れる
+// 同じ投稿を何度取り込んでもよい
+func (s *Server) ingestStatuses(ctx context.Context, statuses []Status, accountId string, host string) (UpsertResult, error) {
+	result, err := s.store.UpsertStatuses(ctx, statuses, accountId, host)
+	if err != nil {
+		return result, err
+	}
+	return result, s.searcher.Index(ctx, statuses)
+}
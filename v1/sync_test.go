@@ -0,0 +1,163 @@
+package activitypublog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chao7150/activitypublog/mastodon"
+)
+
+// accounts/:id/statusesだけを返すインスタンス。liveは新しい順で、1ページ2件
+// failAfterページ返したあとは400を返す。負なら失敗しない
+type fakeInstance struct {
+	live []string
+
+	mu        sync.Mutex
+	failAfter int
+}
+
+func (f *fakeInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := f.failAfter == 0
+	if f.failAfter > 0 {
+		f.failAfter--
+	}
+	f.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxId := r.URL.Query().Get("max_id")
+	page := []mastodon.Status{}
+	for _, id := range f.live {
+		if len(page) == 2 {
+			break
+		}
+		if maxId == "" || compareStatusIds(id, maxId) < 0 {
+			page = append(page, mastodon.Status{Id: id, Visibility: "public", CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)})
+		}
+	}
+	if len(page) > 0 {
+		w.Header().Set("Link", fmt.Sprintf(`<https://%s%s?max_id=%s>; rel="next"`, r.Host, r.URL.Path, page[len(page)-1].Id))
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func newFakeInstanceClient(t *testing.T, f *fakeInstance) *mastodon.Client {
+	t.Helper()
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	client := mastodon.NewClient(strings.TrimPrefix(srv.URL, "https://"), "token", srv.Client())
+	client.MaxRetries = 0
+	return client
+}
+
+func selectDeletedStatusIds(t *testing.T, s *Server) []string {
+	t.Helper()
+	var ids []string
+	err := s.db.NewSelect().Model((*Status)(nil)).Column("id").Where("deleted_at IS NOT NULL").Order("id ASC").Scan(context.Background(), &ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestSyncReconcile(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	f := &fakeInstance{live: []string{"120", "110", "100", "90", "70", "50", "30", "9"}, failAfter: -1}
+	client := newFakeInstanceClient(t, f)
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", client.Host); err != nil {
+		t.Fatal(err)
+	}
+	// 130はたどり始めたあとに投稿されたもの、60はアーカイブから取り込んだもの
+	stored := testStatuses("1", client.Host, "130", "120", "115", "110", "100", "90", "80", "70", "50", "40", "30", "9", "8")
+	imported := testStatuses("1", client.Host, "60")
+	imported[0].Source = StatusSourceImport
+	if _, err := s.store.UpsertStatuses(ctx, append(stored, imported...), "1", client.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	var pageDeleted int64
+	tailDeleted, err := s.syncReconcile(ctx, client, "1", "", func(statuses []Status, result UpsertResult, deleted int64) error {
+		pageDeleted += deleted
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageDeleted != 3 || tailDeleted != 1 {
+		t.Errorf("deleted = %d in pages and %d after the last page, want 3 and 1", pageDeleted, tailDeleted)
+	}
+	if got, want := selectDeletedStatusIds(t, s), []string{"115", "40", "8", "80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted ids = %v, want %v", got, want)
+	}
+}
+
+func TestSyncReconcileResume(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	f := &fakeInstance{live: []string{"120", "110", "100", "90", "70", "50", "30", "9"}, failAfter: 2}
+	client := newFakeInstanceClient(t, f)
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", client.Host); err != nil {
+		t.Fatal(err)
+	}
+	stored := testStatuses("1", client.Host, "120", "115", "110", "100", "90", "80", "70", "50", "40", "30", "9", "8")
+	if _, err := s.store.UpsertStatuses(ctx, stored, "1", client.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	oldestId := ""
+	onPage := func(statuses []Status, result UpsertResult, deleted int64) error {
+		oldestId = statuses[len(statuses)-1].Id
+		return nil
+	}
+	if _, err := s.syncReconcile(ctx, client, "1", "", onPage); err == nil {
+		t.Fatal("want an error from the third page")
+	}
+	// 調べ終えた2ページの範囲だけを削除済みにしている
+	if got, want := selectDeletedStatusIds(t, s), []string{"115"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted ids after the failure = %v, want %v", got, want)
+	}
+
+	f.mu.Lock()
+	f.failAfter = -1
+	f.mu.Unlock()
+	if _, err := s.syncReconcile(ctx, client, "1", oldestId, onPage); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := selectDeletedStatusIds(t, s), []string{"115", "40", "8", "80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted ids after resuming = %v, want %v", got, want)
+	}
+}
+
+func TestSyncReconcileEmptyTimeline(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil)
+	f := &fakeInstance{failAfter: -1}
+	client := newFakeInstanceClient(t, f)
+	if _, err := s.store.InsertAccountIfNotExists(ctx, "1", "alice", client.Host); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.store.UpsertStatuses(ctx, testStatuses("1", client.Host, "20", "10"), "1", client.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.syncReconcile(ctx, client, "1", "", func(statuses []Status, result UpsertResult, deleted int64) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := selectDeletedStatusIds(t, s); deleted != 0 || len(ids) != 0 {
+		t.Errorf("deleted = %d, ids = %v, want nothing deleted for an empty timeline", deleted, ids)
+	}
+}
@@ -0,0 +1,155 @@
+package activitypublog
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var brTagPattern = regexp.MustCompile(`(?i)<br\s*/?>`)
+var paragraphBoundaryPattern = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// contentのHTMLから検索用のプレーンテキストを作る
+func htmlToText(content string) string {
+	s := brTagPattern.ReplaceAllString(content, "\n")
+	s = paragraphBoundaryPattern.ReplaceAllString(s, "\n\n")
+	s = tagPattern.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// インスタンスから来たcontentのうち、表示してよいタグと属性だけを残す。残すものはMastodonのサニタイザーに合わせている
+// 許可していないタグは外して中身の文字だけを残し、scriptなどは中身ごと捨てる
+var allowedContentTags = map[string]bool{
+	"p": true, "br": true, "span": true, "a": true, "del": true, "s": true, "pre": true, "blockquote": true, "code": true,
+	"b": true, "strong": true, "u": true, "i": true, "em": true, "ul": true, "ol": true, "li": true, "ruby": true, "rt": true, "rp": true,
+}
+
+var droppedContentTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true, "template": true,
+	"noscript": true, "textarea": true, "title": true, "svg": true, "math": true,
+}
+
+var allowedContentAttrs = map[string]map[string]bool{
+	"a":    {"href": true, "class": true, "translate": true},
+	"span": {"class": true, "translate": true},
+	"ol":   {"start": true, "reversed": true},
+	"li":   {"value": true},
+}
+
+// メンションやハッシュタグ、長いURLの省略表示に使われるクラスだけを残す
+var allowedContentClassPattern = regexp.MustCompile(`^(?:(?:h|p|u|dt|e)-\S+|mention|hashtag|ellipsis|invisible)$`)
+
+func sanitizeContent(content string) template.HTML {
+	var b strings.Builder
+	var open []string
+	dropping := ""
+	dropDepth := 0
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := z.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		if dropping != "" {
+			switch {
+			case tokenType == html.StartTagToken && tag == dropping:
+				dropDepth++
+			case tokenType == html.EndTagToken && tag == dropping:
+				dropDepth--
+				if dropDepth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+		switch tokenType {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(string(z.Text())))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedContentTags[tag] {
+				if tokenType == html.StartTagToken {
+					dropping = tag
+					dropDepth = 1
+				}
+				continue
+			}
+			if !allowedContentTags[tag] {
+				continue
+			}
+			b.WriteString("<" + tag)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				if v, ok := sanitizeContentAttr(tag, string(key), string(value)); ok {
+					b.WriteString(" " + string(key) + `="` + html.EscapeString(v) + `"`)
+				}
+			}
+			if tag == "a" {
+				b.WriteString(` rel="nofollow noopener noreferrer" target="_blank"`)
+			}
+			b.WriteString(">")
+			if tag != "br" && tokenType == html.StartTagToken {
+				open = append(open, tag)
+			} else if tag != "br" {
+				b.WriteString("</" + tag + ">")
+			}
+		case html.EndTagToken:
+			// 開いていないタグを閉じて周りのHTMLを崩さないように、開いているものだけを閉じる
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tag {
+					writeEndTags(&b, open[i:])
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+	writeEndTags(&b, open)
+	return template.HTML(b.String())
+}
+
+func sanitizeContentAttr(tag string, key string, value string) (string, bool) {
+	if !allowedContentAttrs[tag][key] {
+		return "", false
+	}
+	switch key {
+	case "href":
+		return value, isHttpUrl(value)
+	case "class":
+		var classes []string
+		for _, class := range strings.Fields(value) {
+			if allowedContentClassPattern.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return strings.Join(classes, " "), len(classes) > 0
+	}
+	return value, true
+}
+
+// リンクにしてよいのはhttpとhttpsのURLだけ
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// httpとhttpsのURLでなければ空文字列にする
+func httpUrl(s string) string {
+	if !isHttpUrl(s) {
+		return ""
+	}
+	return s
+}
+
+// 後に開いたものから閉じる
+func writeEndTags(b *strings.Builder, tags []string) {
+	for i := len(tags) - 1; i >= 0; i-- {
+		b.WriteString("</" + tags[i] + ">")
+	}
+}
@@ -0,0 +1,32 @@
+package activitypublog
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestSanitizeContent(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want template.HTML
+	}{
+		{"plain", "<p>hello<br>world</p>", "<p>hello<br>world</p>"},
+		{"text is escaped", "<p>a &lt; b</p>", "<p>a &lt; b</p>"},
+		{"script", `<p>a<script>alert(1)</script>b</p>`, "<p>ab</p>"},
+		{"unknown tag keeps text", "<p><img src=x onerror=alert(1)><font>text</font></p>", "<p>text</p>"},
+		{"event handler", `<span onclick="alert(1)" class="h-card">x</span>`, `<span class="h-card">x</span>`},
+		{"link", `<a href="https://example.com/@alice" class="u-url mention evil">@alice</a>`,
+			`<a href="https://example.com/@alice" class="u-url mention" rel="nofollow noopener noreferrer" target="_blank">@alice</a>`},
+		{"javascript url", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow noopener noreferrer" target="_blank">x</a>`},
+		{"unclosed", "<p><strong>bold", "<p><strong>bold</strong></p>"},
+		{"stray end tag", "a</p></div>b", "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeContent(tt.in); got != tt.want {
+				t.Errorf("sanitizeContent(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}